@@ -0,0 +1,145 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// moduleAuthConfig is the credentials clients must present to scrape a
+// module, in addition to the global bearer token if one is configured.
+type moduleAuthConfig struct {
+	BearerToken       string                 `yaml:"bearer_token" json:"-"`        // no default
+	BearerTokenFile   string                 `yaml:"bearer_token_file"`            // no default
+	Header            string                 `yaml:"header"`                       // Authorization
+	BasicAuthUsername string                 `yaml:"basic_auth_username"`          // no default
+	BasicAuthPassword string                 `yaml:"basic_auth_password" json:"-"` // no default
+	XXX               map[string]interface{} `yaml:",inline"`
+
+	bearerToken       *secret
+	basicAuthUsername *secret
+	basicAuthPassword *secret
+}
+
+func checkModuleAuthConfig(c *moduleAuthConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown auth fields: %v", c.XXX)
+	}
+	bearer := c.BearerToken != "" || c.BearerTokenFile != ""
+	basic := c.BasicAuthUsername != "" || c.BasicAuthPassword != ""
+	switch {
+	case bearer && basic:
+		return errors.New("bearer token and basic auth are mutually exclusive")
+	case !bearer && !basic:
+		return errors.New("auth needs a bearer token or basic auth credentials")
+	case c.BearerToken != "" && c.BearerTokenFile != "":
+		return errors.New("bearer_token and bearer_token_file are mutually exclusive")
+	case basic && (c.BasicAuthUsername == "" || c.BasicAuthPassword == ""):
+		return errors.New("basic auth needs both basic_auth_username and basic_auth_password")
+	case basic && c.Header != "":
+		return errors.New("header can only be used with a bearer token")
+	}
+	if globalBearerHeader() == http.CanonicalHeaderKey(c.header()) {
+		return fmt.Errorf("the global bearer token is already read from the %v header, set -web.bearer.header or the header of a bearer token", c.header())
+	}
+
+	var err error
+	if c.BearerTokenFile != "" {
+		bs, err := ioutil.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed reading bearer_token_file %s, %w", c.BearerTokenFile, err)
+		}
+		t := strings.TrimSpace(string(bs))
+		if t == "" {
+			return fmt.Errorf("bearer_token_file %s should not be empty", c.BearerTokenFile)
+		}
+		c.bearerToken = staticSecret(t)
+	} else if c.BearerToken != "" {
+		if c.bearerToken, err = newSecret(c.BearerToken); err != nil {
+			return fmt.Errorf("bearer_token, %w", err)
+		}
+	}
+	if basic {
+		if c.basicAuthUsername, err = newSecret(c.BasicAuthUsername); err != nil {
+			return fmt.Errorf("basic_auth_username, %w", err)
+		}
+		if c.basicAuthPassword, err = newSecret(c.BasicAuthPassword); err != nil {
+			return fmt.Errorf("basic_auth_password, %w", err)
+		}
+	}
+	return nil
+}
+
+// header returns the request header carrying the credentials.
+func (c *moduleAuthConfig) header() string {
+	if c.Header != "" {
+		return c.Header
+	}
+	return "Authorization"
+}
+
+// globalBearerHeader returns the header the global bearer token is read from
+// on the proxy path, or "" if it isn't required there.
+func globalBearerHeader() string {
+	if !*proxyBearerAuth || (*bearerToken == "" && *bearerTokenFile == "") {
+		return ""
+	}
+	if *bearerHeader != "" {
+		return http.CanonicalHeaderKey(*bearerHeader)
+	}
+	return "Authorization"
+}
+
+// allowed checks the credentials of r. The bearer token is read from Header
+// as is if it is set, otherwise from a Bearer Authorization header.
+func (c *moduleAuthConfig) allowed(r *http.Request) bool {
+	equal := func(a, b string) bool {
+		return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+	}
+
+	if c.bearerToken != nil {
+		token := r.Header.Get(c.header())
+		if c.Header == "" {
+			scheme, t, ok := strings.Cut(token, " ")
+			if !ok || scheme != "Bearer" {
+				return false
+			}
+			token = t
+		}
+		return token != "" && equal(token, c.bearerToken.Get())
+	}
+
+	user, pass, ok := r.BasicAuth()
+	// Both are compared, so that the time taken doesn't tell which is wrong.
+	userOK := equal(user, c.basicAuthUsername.Get())
+	passOK := equal(pass, c.basicAuthPassword.Get())
+	return ok && userOK && passOK
+}
+
+// challenge sets the WWW-Authenticate header of a 401 response for the
+// module.
+func (c *moduleAuthConfig) challenge(w http.ResponseWriter, module string) {
+	if c.bearerToken != nil {
+		if c.Header == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", module))
+}
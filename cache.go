@@ -0,0 +1,200 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheConfig keeps the last successful response of a module, for each
+// distinct set of query parameters, up to MaxEntries of them.
+type cacheConfig struct {
+	TTL               time.Duration          `yaml:"ttl"`                  // no caching
+	StaleIfError      time.Duration          `yaml:"stale_if_error"`       // never
+	ServeStaleOnError bool                   `yaml:"serve_stale_on_error"` // false
+	MaxStaleness      time.Duration          `yaml:"max_staleness"`        // 5m
+	MaxEntries        int                    `yaml:"max_entries"`          // 100
+	XXX               map[string]interface{} `yaml:",inline"`
+
+	mutex   sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+	time   time.Time
+	used   time.Time // last served or stored, for evicting
+}
+
+func checkCacheConfig(c *cacheConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown cache configuration fields: %v", c.XXX)
+	}
+	if c.MaxStaleness < 0 {
+		return fmt.Errorf("max_staleness must not be negative")
+	}
+	if c.TTL < 0 || c.StaleIfError < 0 {
+		return fmt.Errorf("ttl and stale_if_error must not be negative")
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("max_entries must not be negative")
+	}
+	if c.MaxEntries == 0 {
+		c.MaxEntries = 100
+	}
+	if c.StaleIfError > 0 {
+		// stale_if_error is shorthand for serve_stale_on_error with a
+		// max_staleness.
+		if c.ServeStaleOnError || c.MaxStaleness != 0 {
+			return fmt.Errorf("stale_if_error can't be combined with serve_stale_on_error or max_staleness")
+		}
+		c.ServeStaleOnError = true
+		c.MaxStaleness = c.StaleIfError
+	}
+	if c.MaxStaleness == 0 {
+		c.MaxStaleness = 5 * time.Minute
+	}
+	return nil
+}
+
+// cacheKey identifies the responses of a module that can stand in for one
+// another: those to requests with the same query parameters, other than the
+// module name itself, that accept the same formats and encodings. Scrapers
+// negotiating OpenMetrics or protobuf mustn't be served the text format, or
+// the other way round.
+func cacheKey(r *http.Request) string {
+	q := r.URL.Query()
+	if vs := q["module"]; len(vs) > 0 {
+		q["module"] = vs[1:]
+	}
+	return strings.Join([]string{
+		q.Encode(),
+		strings.Join(r.Header.Values("Accept"), ","),
+		strings.Join(r.Header.Values("Accept-Encoding"), ","),
+	}, "\n")
+}
+
+func (c *cacheConfig) get(key string) *cachedResponse {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e := c.entries[key]
+	if e != nil {
+		e.used = time.Now()
+	}
+	return e
+}
+
+// put keeps resp, and drops the entries too old to be served either fresh
+// or stale. If there are still MaxEntries other entries, the least recently
+// used is dropped to make room.
+func (c *cacheConfig) put(key string, resp *cachedResponse) {
+	keep := c.TTL
+	if c.ServeStaleOnError && c.MaxStaleness > keep {
+		keep = c.MaxStaleness
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cachedResponse)
+	}
+	for k, e := range c.entries {
+		if time.Since(e.time) > keep {
+			delete(c.entries, k)
+		}
+	}
+	delete(c.entries, key)
+	for len(c.entries) >= c.MaxEntries {
+		var lru string
+		var lruUsed time.Time
+		for k, e := range c.entries {
+			if lruUsed.IsZero() || e.used.Before(lruUsed) {
+				lru, lruUsed = k, e.used
+			}
+		}
+		delete(c.entries, lru)
+	}
+	resp.used = resp.time
+	c.entries[key] = resp
+}
+
+// serveFresh answers r from the cache if a response to the same parameters
+// is no older than TTL, reporting whether it did.
+func (c *cacheConfig) serveFresh(w http.ResponseWriter, r *http.Request, module string) bool {
+	if c.TTL <= 0 {
+		return false
+	}
+	last := c.get(cacheKey(r))
+	if last == nil {
+		return false
+	}
+	age := time.Since(last.time)
+	if age > c.TTL {
+		return false
+	}
+	log.Debugf("module %v served from cache, %v old", module, age.Round(time.Millisecond))
+	selfMetrics.proxyCacheHitCount.WithLabelValues(module).Inc()
+	w.Header().Set("Age", fmt.Sprintf("%.0f", age.Seconds()))
+	writeResponse(w, last.header, http.StatusOK, last.body)
+	return true
+}
+
+// serve responds with the response of next, keeping it if it is successful.
+// If it failed, the last successful response is served instead if it is no
+// older than MaxStaleness.
+func (c *cacheConfig) serve(w http.ResponseWriter, r *http.Request, module string, next http.HandlerFunc) {
+	rec := httptest.NewRecorder()
+	next(rec, r)
+
+	key := cacheKey(r)
+	if rec.Code == http.StatusOK && r.Context().Err() == nil {
+		c.put(key, &cachedResponse{
+			header: rec.Header().Clone(),
+			body:   rec.Body.Bytes(),
+			time:   time.Now(),
+		})
+		writeResponse(w, rec.Header(), rec.Code, rec.Body.Bytes())
+		return
+	}
+
+	last := c.get(key)
+	if c.ServeStaleOnError && last != nil {
+		if age := time.Since(last.time); age <= c.MaxStaleness {
+			log.Warnf("module %v scrape failed with status %d, serving response from %v ago", module, rec.Code, age.Round(time.Second))
+			selfMetrics.proxyStaleCount.WithLabelValues(module).Inc()
+			w.Header().Set("X-Expexp-Stale", fmt.Sprintf("%.0f", age.Seconds()))
+			writeResponse(w, last.header, http.StatusOK, last.body)
+			return
+		}
+	}
+	writeResponse(w, rec.Header(), rec.Code, rec.Body.Bytes())
+}
+
+// writeResponse writes a complete response, adding header to any headers
+// already set on w.
+func writeResponse(w http.ResponseWriter, header http.Header, status int, body []byte) {
+	for k, vs := range header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -14,16 +14,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -33,10 +44,18 @@ type config struct {
 	Discovery *discoveryConfig
 	XXX       map[string]interface{} `yaml:",inline"`
 
-	bearerToken   string
+	bearerToken   *secret
+	routePrefix   string
 	proxyPath     string
 	telemetryPath string
 
+	aliases map[string]string
+	secrets map[string]*secret // from providers, of the modules, by reference
+
+	// loaded is set, atomically, once all of the modules have been loaded,
+	// including those found by the first discovery run.
+	loaded int32
+
 	mutex sync.RWMutex
 }
 
@@ -67,63 +86,318 @@ func (cfg *config) getModule(name string) *moduleConfig {
 	if m, ok := cfg.Modules[name]; ok {
 		return m
 	}
+	if target, ok := cfg.aliases[name]; ok {
+		return cfg.Modules[target]
+	}
+	return nil
+}
+
+// buildAliases (re)computes the alias lookup table from the loaded modules.
+// Aliases may not shadow a real module name, or be claimed by more than one
+// module.
+func (cfg *config) buildAliases() error {
+	cfg.mutex.Lock()
+	defer cfg.mutex.Unlock()
+
+	aliases := make(map[string]string)
+	for name, m := range cfg.Modules {
+		for _, a := range m.Aliases {
+			if _, ok := cfg.Modules[a]; ok {
+				return fmt.Errorf("alias %s of module %s collides with an existing module name", a, name)
+			}
+			if other, ok := aliases[a]; ok && other != name {
+				return fmt.Errorf("alias %s is used by both module %s and module %s", a, other, name)
+			}
+			aliases[a] = name
+		}
+	}
+	cfg.aliases = aliases
 	return nil
 }
 
-func (cfg *config) addModule(name string, m *moduleConfig) {
+func (cfg *config) addModule(name string, m *moduleConfig) error {
 	cfg.mutex.Lock()
+	defer cfg.mutex.Unlock()
+	if _, ok := cfg.Modules[name]; !ok && *maxModules > 0 && len(cfg.Modules) >= *maxModules {
+		return fmt.Errorf("can't add module %v, the limit of %d modules (-config.max-modules) has been reached", name, *maxModules)
+	}
 	cfg.Modules[name] = m
+	return nil
+}
+
+// removeModule removes a module, and its per-module metrics.
+func (cfg *config) removeModule(name string) {
+	cfg.mutex.Lock()
+	m, ok := cfg.Modules[name]
+	delete(cfg.Modules, name)
 	cfg.mutex.Unlock()
+	if ok {
+		selfMetrics.moduleInfo.DeleteLabelValues(name, m.Method, m.backend())
+		selfMetrics.moduleLastScrape.DeleteLabelValues(name)
+		selfMetrics.moduleHealth.removed(name)
+	}
 }
 
+const (
+	// extraModuleParamsReject fails requests with more than one distinct
+	// module parameter with a 400.
+	extraModuleParamsReject = "reject"
+	// extraModuleParamsForward passes module parameters after the first on
+	// to http backends, as needed by the blackbox exporter.
+	extraModuleParamsForward = "forward"
+)
+
+const (
+	// timeoutResponseGatewayTimeout fails timed out scrapes with a 504.
+	timeoutResponseGatewayTimeout = "gateway-timeout"
+	// timeoutResponseEmptyOK answers timed out scrapes with a 200 and a
+	// single expexp_module_up 0 sample.
+	timeoutResponseEmptyOK = "empty-ok"
+)
+
 type moduleConfig struct {
-	Method  string                 `yaml:"method"`
-	Timeout time.Duration          `yaml:"timeout"`
-	XXX     map[string]interface{} `yaml:",inline"`
+	Method               string                 `yaml:"method"`
+	Timeout              time.Duration          `yaml:"timeout"`
+	Aliases              []string               `yaml:"aliases"`
+	WarnDeprecatedAlias  bool                   `yaml:"warn_deprecated_alias"`
+	TimeoutResponse      string                 `yaml:"timeout_response"`       // gateway-timeout
+	TimeoutHeader        string                 `yaml:"timeout_header"`         // -proxy.timeout-header
+	EnabledIf            *moduleCondition       `yaml:"enabled_if"`             // always enabled
+	MaxConcurrency       int                    `yaml:"max_concurrency"`        // unlimited
+	Optional             bool                   `yaml:"optional"`               // false
+	Cache                *cacheConfig           `yaml:"cache"`                  // no caching
+	AllowedParams        []string               `yaml:"allowed_params"`         // all params
+	OnError              *onErrorConfig         `yaml:"on_error"`               // 502, or 504 on timeouts
+	CacheControl         string                 `yaml:"cache_control"`          // no header
+	FailOnEmpty          bool                   `yaml:"fail_on_empty"`          // false
+	Mirror               *mirrorConfig          `yaml:"mirror"`                 // no mirroring
+	ExtraModuleParams    string                 `yaml:"extra_module_params"`    // reject
+	MetricPrefix         string                 `yaml:"metric_prefix"`          // no prefix
+	InjectLabels         map[string]string      `yaml:"inject_labels"`          // no labels
+	MetricRelabelConfigs []*relabelConfig       `yaml:"metric_relabel_configs"` // no relabelling
+	TargetLabels         map[string]string      `yaml:"target_labels"`          // no labels
+	AllowedClientCerts   []string               `yaml:"allowed_client_certs"`   // any client
+	Auth                 *moduleAuthConfig      `yaml:"auth"`                   // no credentials
+	FilterCommand        *filterConfig          `yaml:"filter_command"`         // no filter
+	XXX                  map[string]interface{} `yaml:",inline"`
+
+	Exec     execConfig     `yaml:"exec"`
+	HTTP     httpConfig     `yaml:"http"`
+	Federate federateConfig `yaml:"federate"`
+	File     fileConfig     `yaml:"file"`
+
+	name       string
+	disabled   bool
+	slots      chan struct{}
+	maxAge     time.Duration     // -1 if there is no max-age
+	labels     map[string]string // target labels of discovered modules
+	discovered bool              // kept across reloads
+
+	allowedClientCerts []*regexp.Regexp
+}
+
+var cacheControlDirective = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+(=([A-Za-z0-9!#$%&'*+.^_|~-]+|"[^"]*"))?$`)
+
+// parseCacheControl checks that v is a valid Cache-Control header value, and
+// returns its max-age, or -1 if it has none.
+func parseCacheControl(v string) (time.Duration, error) {
+	maxAge := time.Duration(-1)
+	if v == "" {
+		return maxAge, nil
+	}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if !cacheControlDirective.MatchString(d) {
+			return 0, fmt.Errorf("invalid directive %q", d)
+		}
+		name, value, _ := strings.Cut(d, "=")
+		if strings.EqualFold(name, "max-age") {
+			secs, err := strconv.Atoi(value)
+			if err != nil || secs < 0 {
+				return 0, fmt.Errorf("max-age must be a number of seconds, not %q", value)
+			}
+			maxAge = time.Duration(secs) * time.Second
+		}
+	}
+	return maxAge, nil
+}
+
+// setCacheHeaders adds the configured Cache-Control header, and the matching
+// Expires header, to h.
+func (cfg moduleConfig) setCacheHeaders(h http.Header) {
+	if cfg.CacheControl == "" {
+		return
+	}
+	h.Set("Cache-Control", cfg.CacheControl)
+	if cfg.maxAge >= 0 {
+		h.Set("Expires", time.Now().Add(cfg.maxAge).UTC().Format(http.TimeFormat))
+	}
+}
+
+// onErrorConfig is the response to failed scrapes of a module.
+type onErrorConfig struct {
+	Status   int                    `yaml:"status"`
+	Body     string                 `yaml:"body"`
+	BodyFile string                 `yaml:"body_file"`
+	XXX      map[string]interface{} `yaml:",inline"`
+
+	body []byte
+}
+
+func checkOnErrorConfig(c *onErrorConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown on_error configuration fields: %v", c.XXX)
+	}
+	if c.Status < 100 || c.Status > 599 {
+		return fmt.Errorf("status must be an HTTP status code, not %d", c.Status)
+	}
+	if c.Body != "" && c.BodyFile != "" {
+		return fmt.Errorf("body and body_file are mutually exclusive")
+	}
+	c.body = []byte(c.Body)
+	if c.BodyFile != "" {
+		bs, err := ioutil.ReadFile(c.BodyFile)
+		if err != nil {
+			return fmt.Errorf("failed reading body_file %s, %w", c.BodyFile, err)
+		}
+		c.body = bs
+	}
+	return nil
+}
+
+// write sends the configured error response.
+func (c *onErrorConfig) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(c.Status)
+	_, _ = w.Write(c.body)
+}
+
+// moduleCondition restricts a module to hosts matching all of the given
+// regular expressions, which must match the whole value.
+type moduleCondition struct {
+	Hostname string                 `yaml:"hostname"`
+	Env      map[string]string      `yaml:"env"`
+	XXX      map[string]interface{} `yaml:",inline"`
+}
+
+// enabled evaluates the condition for the current host.
+func (c *moduleCondition) enabled() (bool, error) {
+	if len(c.XXX) != 0 {
+		return false, fmt.Errorf("unknown enabled_if fields: %v", c.XXX)
+	}
 
-	Exec execConfig `yaml:"exec"`
-	HTTP httpConfig `yaml:"http"`
+	match := func(expr, v string) (bool, error) {
+		rx, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return false, err
+		}
+		return rx.MatchString(v), nil
+	}
 
-	name string
+	ok := true
+	if c.Hostname != "" {
+		hn, err := os.Hostname()
+		if err != nil {
+			return false, fmt.Errorf("could not determine hostname, %w", err)
+		}
+		if ok, err = match(c.Hostname, hn); err != nil {
+			return false, fmt.Errorf("invalid hostname regexp, %w", err)
+		}
+	}
+	for k, expr := range c.Env {
+		m, err := match(expr, os.Getenv(k))
+		if err != nil {
+			return false, fmt.Errorf("invalid regexp for env %s, %w", k, err)
+		}
+		ok = ok && m
+	}
+	return ok, nil
 }
 
 type discoveryConfig struct {
 	Enabled   bool   `yaml:"enabled"`
+	Type      string `yaml:"type"` // probe the exporters
 	Interval  string `yaml:"interval"`
 	interval  time.Duration
 	Address   string               `yaml:"target"` // default localhost
 	Exporters map[string]*exporter `yaml:"exporters"`
+
+	ProbeTimeout     time.Duration `yaml:"probe_timeout"`     // 200ms for TCP, 3s for HTTP
+	ProbeConcurrency int           `yaml:"probe_concurrency"` // 10
+
+	Kubernetes *kubernetesDiscoveryConfig `yaml:"kubernetes"` // in-cluster defaults
+	Docker     *dockerDiscoveryConfig     `yaml:"docker"`     // the local docker socket
 }
 
 type exporter struct {
-	Port int    `yaml:"port"`
-	Path string `yaml:"path"`
+	Port   int                       `yaml:"port"`
+	Path   string                    `yaml:"path"`
+	Labels map[string]discoveryLabel `yaml:"labels"` // no labels
+}
+
+// discoveryLabel is a label of a discovered exporter. Labels are added to the
+// file_sd targets written by -discovery.oneshot, or if Inject is set, to the
+// metrics of the exporter.
+type discoveryLabel struct {
+	Value  string `yaml:"value"`
+	Inject bool   `yaml:"inject"` // false
 }
 
 type httpConfig struct {
-	TLSInsecureSkipVerify bool                   `yaml:"tls_insecure_skip_verify"` // false
-	TLSCertFile           *string                `yaml:"tls_cert_file"`            // no default
-	TLSKeyFile            *string                `yaml:"tls_key_file"`             // no default
-	TLSCACertFile         *string                `yaml:"tls_ca_cert_file"`         // no default
-	Port                  int                    `yaml:"port"`                     // no default
-	Path                  string                 `yaml:"path"`                     // /metrics
-	Scheme                string                 `yaml:"scheme"`                   // http
-	Address               string                 `yaml:"address"`                  // 127.0.0.1
-	Headers               map[string]string      `yaml:"headers"`                  // no default
-	BasicAuthUsername     string                 `yaml:"basic_auth_username"`      // no default
-	BasicAuthPassword     string                 `yaml:"basic_auth_password"`      // no default
+	TLSInsecureSkipVerify bool                   `yaml:"tls_insecure_skip_verify"`      // false
+	TLSCertFile           *string                `yaml:"tls_cert_file"`                 // no default
+	TLSKeyFile            *string                `yaml:"tls_key_file"`                  // no default
+	TLSCACertFile         *string                `yaml:"tls_ca_cert_file"`              // no default
+	Port                  int                    `yaml:"port"`                          // no default
+	Path                  string                 `yaml:"path"`                          // /metrics
+	PathParams            map[string]string      `yaml:"path_params"`                   // no templating
+	Scheme                string                 `yaml:"scheme"`                        // http
+	Address               string                 `yaml:"address"`                       // 127.0.0.1
+	Headers               map[string]string      `yaml:"headers"`                       // no default
+	ForwardHeaders        []string               `yaml:"forward_headers"`               // all headers
+	AcceptParams          map[string]string      `yaml:"accept_params"`                 // no default
+	StripHeaders          []string               `yaml:"strip_headers"`                 // no default
+	BasicAuthUsername     string                 `yaml:"basic_auth_username"`           // no default
+	BasicAuthPassword     string                 `yaml:"basic_auth_password" json:"-"`  // no default
+	BearerToken           string                 `yaml:"bearer_token" json:"-"`         // no default
+	BearerTokenFile       string                 `yaml:"bearer_token_file"`             // no default
+	DigestAuthUsername    string                 `yaml:"digest_auth_username"`          // no default
+	DigestAuthPassword    string                 `yaml:"digest_auth_password" json:"-"` // no default
+	DNSCacheTTL           time.Duration          `yaml:"dns_cache_ttl"`                 // no caching
+	DNSCacheGrace         time.Duration          `yaml:"dns_cache_grace"`               // dns_cache_ttl
+	BufferResponse        bool                   `yaml:"buffer_response"`               // false
+	AcceptGzip            bool                   `yaml:"accept_gzip"`                   // false
+	MaxResponseBytes      int64                  `yaml:"max_response_bytes"`            // no limit
+	FlushInterval         time.Duration          `yaml:"flush_interval"`                // 0
+	ResponseHeaderTimeout time.Duration          `yaml:"response_header_timeout"`       // module timeout only
+	PaginateParam         string                 `yaml:"paginate_param"`                // no pagination
+	MaxPages              int                    `yaml:"max_pages"`                     // 10
+	ResponseReplacements  []*responseReplacement `yaml:"response_replacements"`         // no replacements
+	Login                 *loginConfig           `yaml:"login"`                         // no login
 	XXX                   map[string]interface{} `yaml:",inline"`
 
+	basicAuthUsername      *secret
+	basicAuthPassword      *secret
+	bearerToken            *secret
+	digestAuthUsername     *secret
+	digestAuthPassword     *secret
+	pathTemplate           *template.Template
+	pathParamREs           map[string]*regexp.Regexp
 	tlsConfig              *tls.Config
 	mcfg                   *moduleConfig
 	*httputil.ReverseProxy `json:"-"`
 }
 
 type execConfig struct {
-	Command string                 `yaml:"command"`
-	Args    []string               `yaml:"args"`
-	Env     map[string]string      `yaml:"env"`
-	XXX     map[string]interface{} `yaml:",inline"`
+	Command          string                 `yaml:"command"`
+	Args             []string               `yaml:"args"`
+	Env              map[string]string      `yaml:"env"`
+	SuccessExitCodes []int                  `yaml:"success_exit_codes"` // [0]
+	Stream           bool                   `yaml:"stream"`             // false
+	FlushInterval    time.Duration          `yaml:"flush_interval"`     // flush every write
+	Retries          int                    `yaml:"retries"`            // 0
+	RetryBackoff     time.Duration          `yaml:"retry_backoff"`      // 0
+	XXX              map[string]interface{} `yaml:",inline"`
 
 	mcfg *moduleConfig
 }
@@ -139,10 +413,17 @@ func readConfig(r io.Reader) (*config, error) {
 		return nil, fmt.Errorf("unknown configuration fields: %v", cfg.XXX)
 	}
 
+	if cfg.Modules == nil {
+		cfg.Modules = make(map[string]*moduleConfig)
+	}
 	for s := range cfg.Modules {
 		if err = checkModuleConfig(s, cfg.Modules[s]); err != nil {
 			return nil, fmt.Errorf("bad config for module %s, %w", s, err)
 		}
+		if cfg.Modules[s].disabled {
+			log.Infof("module %s is disabled by its enabled_if condition", s)
+			delete(cfg.Modules, s)
+		}
 	}
 
 	return &cfg, err
@@ -162,6 +443,64 @@ func readModuleConfig(name string, r io.Reader) (*moduleConfig, error) {
 	return &cfg, nil
 }
 
+// namedModuleConfig is a module config read from a multi-document modules
+// file, where the module name is given in the document itself.
+type namedModuleConfig struct {
+	Name   string
+	Module *moduleConfig
+}
+
+// readModuleConfigs reads a stream of YAML documents, each a module config
+// with an additional name field. Empty documents are ignored.
+func readModuleConfigs(r io.Reader) ([]namedModuleConfig, error) {
+	var mcfgs []namedModuleConfig
+	seen := make(map[string]bool)
+	dec := yaml.NewDecoder(r)
+	for i := 1; ; i++ {
+		var doc yaml.MapSlice
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d, %w", i, err)
+		}
+		if len(doc) == 0 {
+			continue
+		}
+
+		// Split off the name, and read the rest exactly like a module
+		// config file.
+		name := ""
+		var rest yaml.MapSlice
+		for _, item := range doc {
+			if item.Key == "name" {
+				name, _ = item.Value.(string)
+				continue
+			}
+			rest = append(rest, item)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("document %d has no module name", i)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("module %s is defined more than once", name)
+		}
+		seen[name] = true
+
+		bs, err := yaml.Marshal(rest)
+		if err != nil {
+			return nil, fmt.Errorf("bad config for module %s, %w", name, err)
+		}
+		mcfg, err := readModuleConfig(name, bytes.NewReader(bs))
+		if err != nil {
+			return nil, fmt.Errorf("bad config for module %s, %w", name, err)
+		}
+		mcfgs = append(mcfgs, namedModuleConfig{Name: name, Module: mcfg})
+	}
+	return mcfgs, nil
+}
+
 func checkModuleConfig(name string, cfg *moduleConfig) error {
 	if len(cfg.XXX) != 0 {
 		return fmt.Errorf("unknown module configuration fields: %v", cfg.XXX)
@@ -169,6 +508,114 @@ func checkModuleConfig(name string, cfg *moduleConfig) error {
 
 	cfg.name = name
 
+	for _, a := range cfg.Aliases {
+		if a == "" || a == name {
+			return fmt.Errorf("invalid alias %q for module %v", a, name)
+		}
+	}
+
+	if cfg.EnabledIf != nil {
+		enabled, err := cfg.EnabledIf.enabled()
+		if err != nil {
+			return fmt.Errorf("bad enabled_if, %w", err)
+		}
+		cfg.disabled = !enabled
+	}
+
+	if cfg.Cache != nil {
+		if err := checkCacheConfig(cfg.Cache); err != nil {
+			return fmt.Errorf("bad cache for module %v, %w", name, err)
+		}
+	}
+
+	maxAge, err := parseCacheControl(cfg.CacheControl)
+	if err != nil {
+		return fmt.Errorf("bad cache_control for module %v, %w", name, err)
+	}
+	cfg.maxAge = maxAge
+
+	if cfg.Mirror != nil {
+		if err := checkMirrorConfig(cfg.Mirror); err != nil {
+			return fmt.Errorf("bad mirror for module %v, %w", name, err)
+		}
+	}
+
+	if cfg.MetricPrefix != "" {
+		if err := checkMetricPrefix(cfg.MetricPrefix); err != nil {
+			return fmt.Errorf("bad metric_prefix for module %v, %w", name, err)
+		}
+	}
+	for l := range cfg.InjectLabels {
+		if err := checkLabelName(l); err != nil {
+			return fmt.Errorf("bad inject_labels for module %v, %w", name, err)
+		}
+	}
+	for l := range cfg.TargetLabels {
+		if err := checkLabelName(l); err != nil {
+			return fmt.Errorf("bad target_labels for module %v, %w", name, err)
+		}
+	}
+	for i, rc := range cfg.MetricRelabelConfigs {
+		if err := checkRelabelConfig(rc); err != nil {
+			return fmt.Errorf("bad metric_relabel_configs rule %d for module %v, %w", i, name, err)
+		}
+	}
+	if cfg.rewrites() && cfg.Method == "exec" && cfg.Exec.Stream {
+		return fmt.Errorf("metric_prefix, inject_labels and metric_relabel_configs can't be used with stream in module %v", name)
+	}
+
+	if cfg.FilterCommand != nil {
+		if err := checkFilterConfig(cfg.FilterCommand); err != nil {
+			return fmt.Errorf("bad filter_command for module %v, %w", name, err)
+		}
+		if cfg.Method != "http" && (cfg.Method != "exec" || cfg.Exec.Stream) {
+			return fmt.Errorf("filter_command can only be used with http modules, and exec modules that don't stream, in module %v", name)
+		}
+	}
+
+	for _, p := range cfg.AllowedClientCerts {
+		rx, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return fmt.Errorf("bad allowed_client_certs for module %v, %w", name, err)
+		}
+		cfg.allowedClientCerts = append(cfg.allowedClientCerts, rx)
+	}
+
+	if cfg.Auth != nil {
+		if err := checkModuleAuthConfig(cfg.Auth); err != nil {
+			return fmt.Errorf("bad auth for module %v, %w", name, err)
+		}
+	}
+
+	if cfg.OnError != nil {
+		if err := checkOnErrorConfig(cfg.OnError); err != nil {
+			return fmt.Errorf("bad on_error for module %v, %w", name, err)
+		}
+	}
+
+	if cfg.MaxConcurrency < 0 {
+		return fmt.Errorf("max_concurrency must not be negative for module %v", name)
+	}
+	if cfg.MaxConcurrency > 0 {
+		cfg.slots = make(chan struct{}, cfg.MaxConcurrency)
+	}
+
+	switch cfg.ExtraModuleParams {
+	case "":
+		cfg.ExtraModuleParams = extraModuleParamsReject
+	case extraModuleParamsReject, extraModuleParamsForward:
+	default:
+		return fmt.Errorf("unknown extra_module_params %q, must be one of %v or %v", cfg.ExtraModuleParams, extraModuleParamsReject, extraModuleParamsForward)
+	}
+
+	switch cfg.TimeoutResponse {
+	case "":
+		cfg.TimeoutResponse = timeoutResponseGatewayTimeout
+	case timeoutResponseGatewayTimeout, timeoutResponseEmptyOK:
+	default:
+		return fmt.Errorf("unknown timeout_response %q, must be one of %v or %v", cfg.TimeoutResponse, timeoutResponseGatewayTimeout, timeoutResponseEmptyOK)
+	}
+
 	switch cfg.Method {
 	case "http":
 		if len(cfg.HTTP.XXX) != 0 {
@@ -185,9 +632,65 @@ func checkModuleConfig(name string, cfg *moduleConfig) error {
 		if cfg.HTTP.Path == "" {
 			cfg.HTTP.Path = "/metrics"
 		}
+		if u, err := url.Parse(cfg.HTTP.Path); err == nil && (u.Scheme != "" || u.Host != "") {
+			return fmt.Errorf("path %q of module %v is a URL, set the scheme, address and port of the backend in scheme, address and port instead", cfg.HTTP.Path, name)
+		}
 		if cfg.HTTP.Address == "" {
 			cfg.HTTP.Address = "localhost"
 		}
+		if err := cfg.HTTP.checkPathTemplate(); err != nil {
+			return fmt.Errorf("bad path of module %v, %w", name, err)
+		}
+
+		var err error
+		if cfg.HTTP.basicAuthUsername, err = newSecret(cfg.HTTP.BasicAuthUsername); err != nil {
+			return fmt.Errorf("basic_auth_username, %w", err)
+		}
+		if cfg.HTTP.basicAuthPassword, err = newSecret(cfg.HTTP.BasicAuthPassword); err != nil {
+			return fmt.Errorf("basic_auth_password, %w", err)
+		}
+
+		if cfg.HTTP.Login != nil {
+			if err := checkLoginConfig(cfg.HTTP.Login); err != nil {
+				return fmt.Errorf("bad login, %w", err)
+			}
+		}
+
+		if cfg.HTTP.BearerToken != "" && cfg.HTTP.BearerTokenFile != "" {
+			return fmt.Errorf("bearer_token and bearer_token_file are mutually exclusive")
+		}
+		if (cfg.HTTP.BearerToken != "" || cfg.HTTP.BearerTokenFile != "") && (cfg.HTTP.BasicAuthUsername != "" || cfg.HTTP.BasicAuthPassword != "") {
+			return fmt.Errorf("bearer token and basic auth are mutually exclusive")
+		}
+		if cfg.HTTP.DigestAuthUsername != "" || cfg.HTTP.DigestAuthPassword != "" {
+			if cfg.HTTP.DigestAuthUsername == "" || cfg.HTTP.DigestAuthPassword == "" {
+				return fmt.Errorf("digest_auth_username and digest_auth_password must be set together")
+			}
+			if cfg.HTTP.BasicAuthUsername != "" || cfg.HTTP.BasicAuthPassword != "" || cfg.HTTP.BearerToken != "" || cfg.HTTP.BearerTokenFile != "" {
+				return fmt.Errorf("digest auth, basic auth and bearer token are mutually exclusive")
+			}
+			if cfg.HTTP.digestAuthUsername, err = newSecret(cfg.HTTP.DigestAuthUsername); err != nil {
+				return fmt.Errorf("digest_auth_username, %w", err)
+			}
+			if cfg.HTTP.digestAuthPassword, err = newSecret(cfg.HTTP.DigestAuthPassword); err != nil {
+				return fmt.Errorf("digest_auth_password, %w", err)
+			}
+		}
+		if cfg.HTTP.BearerTokenFile != "" {
+			bs, err := ioutil.ReadFile(cfg.HTTP.BearerTokenFile)
+			if err != nil {
+				return fmt.Errorf("failed reading bearer_token_file %s, %w", cfg.HTTP.BearerTokenFile, err)
+			}
+			t := strings.TrimSpace(string(bs))
+			if len(t) == 0 {
+				return fmt.Errorf("bearer_token_file %s should not be empty", cfg.HTTP.BearerTokenFile)
+			}
+			cfg.HTTP.bearerToken = staticSecret(t)
+		} else if cfg.HTTP.BearerToken != "" {
+			if cfg.HTTP.bearerToken, err = newSecret(cfg.HTTP.BearerToken); err != nil {
+				return fmt.Errorf("bearer_token, %w", err)
+			}
+		}
 
 		tlsConfig, err := cfg.HTTP.getTLSConfig()
 		if err != nil {
@@ -199,16 +702,79 @@ func checkModuleConfig(name string, cfg *moduleConfig) error {
 			return err
 		}
 
+		if cfg.HTTP.DNSCacheTTL < 0 || cfg.HTTP.DNSCacheGrace < 0 {
+			return fmt.Errorf("dns_cache_ttl and dns_cache_grace must not be negative")
+		}
+		if cfg.HTTP.DNSCacheGrace == 0 {
+			cfg.HTTP.DNSCacheGrace = cfg.HTTP.DNSCacheTTL
+		}
+
+		if cfg.HTTP.ResponseHeaderTimeout < 0 {
+			return fmt.Errorf("response_header_timeout must not be negative")
+		}
+
+		for _, rr := range cfg.HTTP.ResponseReplacements {
+			if len(rr.XXX) != 0 {
+				return fmt.Errorf("unknown response_replacements fields: %v", rr.XXX)
+			}
+			if rr.From == "" {
+				return fmt.Errorf("response_replacements must have a from string")
+			}
+		}
+
+		if cfg.HTTP.MaxPages < 0 {
+			return fmt.Errorf("max_pages must not be negative")
+		}
+		if cfg.HTTP.MaxPages != 0 && cfg.HTTP.PaginateParam == "" {
+			return fmt.Errorf("max_pages requires paginate_param to be set")
+		}
+		if cfg.HTTP.PaginateParam != "" && cfg.HTTP.MaxPages == 0 {
+			cfg.HTTP.MaxPages = 10
+		}
+
+		if cfg.HTTP.MaxResponseBytes < 0 {
+			return fmt.Errorf("max_response_bytes must not be negative")
+		}
+		if cfg.HTTP.MaxResponseBytes != 0 && !cfg.HTTP.BufferResponse {
+			return fmt.Errorf("max_response_bytes requires buffer_response to be set")
+		}
+
+		var transport http.RoundTripper = cfg.HTTP.newTransport(name, tlsConfig)
+		if cfg.HTTP.digestAuthUsername != nil {
+			transport = &digestTransport{
+				next:     transport,
+				username: cfg.HTTP.digestAuthUsername,
+				password: cfg.HTTP.digestAuthPassword,
+			}
+		}
+
 		cfg.HTTP.tlsConfig = tlsConfig
 		cfg.HTTP.ReverseProxy = &httputil.ReverseProxy{
-			Transport:    &http.Transport{TLSClientConfig: tlsConfig},
-			Director:     dirFunc,
-			ErrorHandler: cfg.getReverseProxyErrorHandlerFunc(),
+			Transport:      transport,
+			Director:       dirFunc,
+			ModifyResponse: cfg.getReverseProxyModifyResponseFunc(transport),
+			ErrorHandler:   cfg.getReverseProxyErrorHandlerFunc(),
+			FlushInterval:  cfg.HTTP.FlushInterval,
 		}
 	case "exec":
 		if len(cfg.Exec.XXX) != 0 {
 			return fmt.Errorf("unknown exec module configuration fields: %v", cfg.Exec.XXX)
 		}
+		if *disableExec {
+			return fmt.Errorf("exec module %v can't be used with -disable.exec", name)
+		}
+
+		if cfg.Exec.Retries < 0 || cfg.Exec.RetryBackoff < 0 {
+			return fmt.Errorf("retries and retry_backoff of module %v must not be negative", name)
+		}
+	case "federate":
+		if err := checkFederateConfig(&cfg.Federate); err != nil {
+			return fmt.Errorf("bad federate config for module %v, %w", name, err)
+		}
+	case "file":
+		if err := checkFileConfig(&cfg.File); err != nil {
+			return fmt.Errorf("bad file config for module %v, %w", name, err)
+		}
 	default:
 		return fmt.Errorf("unknown module method: %v", cfg.Method)
 	}
@@ -216,6 +782,106 @@ func checkModuleConfig(name string, cfg *moduleConfig) error {
 	return nil
 }
 
+// backend describes the module backend, without any credentials or query
+// parameters.
+func (cfg moduleConfig) backend() string {
+	switch cfg.Method {
+	case "http":
+		u := url.URL{
+			Scheme: cfg.HTTP.Scheme,
+			Host:   net.JoinHostPort(cfg.HTTP.Address, strconv.Itoa(cfg.HTTP.Port)),
+		}
+		if p, err := url.Parse(cfg.HTTP.Path); err == nil {
+			u.Path = p.Path
+		}
+		return u.String()
+	case "exec":
+		return cfg.Exec.Command
+	case "federate":
+		return cfg.Federate.describe()
+	case "file":
+		return cfg.File.describe()
+	default:
+		return ""
+	}
+}
+
+// backendCheck is the result of checking the backend of an http module.
+type backendCheck struct {
+	module   string
+	backend  string
+	optional bool
+	err      error
+}
+
+func (c backendCheck) String() string {
+	switch {
+	case c.err == nil:
+		return fmt.Sprintf("module %v backend %v is reachable", c.module, c.backend)
+	case c.optional:
+		return fmt.Sprintf("optional module %v backend %v is unreachable, %v", c.module, c.backend, c.err)
+	default:
+		return fmt.Sprintf("module %v backend %v is unreachable, %v", c.module, c.backend, c.err)
+	}
+}
+
+// checkBackends checks that the backend of each http module that is not in
+// prev with the same backend accepts TCP connections, and is allowed by
+// -backend.allowed-targets. The results are returned sorted by module, with an
+// error if the backend of any module that isn't optional is unreachable.
+func (cfg *config) checkBackends(timeout time.Duration, prev map[string]*moduleConfig) ([]backendCheck, error) {
+	dial := checkedDial((&net.Dialer{}).DialContext, net.DefaultResolver.LookupHost)
+	var checks []backendCheck
+	var failed []string
+	for name, m := range cfg.GetModules() {
+		if m.Method != "http" {
+			continue
+		}
+		addr := net.JoinHostPort(m.HTTP.Address, strconv.Itoa(m.HTTP.Port))
+		if p, ok := prev[name]; ok && p.Method == "http" &&
+			net.JoinHostPort(p.HTTP.Address, strconv.Itoa(p.HTTP.Port)) == addr {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err := dial(ctx, "tcp", addr)
+		cancel()
+		c := backendCheck{module: name, backend: addr, optional: m.Optional, err: err}
+		checks = append(checks, c)
+		switch {
+		case err == nil:
+			conn.Close()
+			log.Debug(c)
+		case m.Optional:
+			log.Warn(c)
+		default:
+			log.Error(c)
+			failed = append(failed, name)
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].module < checks[j].module })
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return checks, fmt.Errorf("backends of modules %v are unreachable", strings.Join(failed, ", "))
+	}
+	return checks, nil
+}
+
+func (c httpConfig) newTransport(module string, tlsConfig *tls.Config) *http.Transport {
+	dial, lookup := (&net.Dialer{}).DialContext, net.DefaultResolver.LookupHost
+	if c.DNSCacheTTL > 0 {
+		cache := newDNSCache(c.DNSCacheTTL, c.DNSCacheGrace)
+		dial, lookup = cache.DialContext, cache.lookup
+	}
+	return &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		IdleConnTimeout:       *backendIdleConnTimeout,
+		MaxIdleConnsPerHost:   *backendMaxIdleConnsPerHost,
+		DialContext:           countingDial(module, checkedDial(dial, lookup)),
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+	}
+}
+
 func (c httpConfig) getTLSConfig() (*tls.Config, error) {
 	config := &tls.Config{
 		InsecureSkipVerify: c.TLSInsecureSkipVerify,
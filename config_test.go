@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildAliases(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`
+modules:
+  node_exporter:
+    method: exec
+    aliases: [node]
+    exec:
+      command: /bin/true
+`))
+	if err != nil {
+		t.Fatalf("failed reading config: %v", err)
+	}
+	if err := cfg.buildAliases(); err != nil {
+		t.Fatalf("failed building aliases: %v", err)
+	}
+
+	m := cfg.getModule("node")
+	if m == nil || m.name != "node_exporter" {
+		t.Fatalf("expected alias node to resolve to node_exporter, got %v", m)
+	}
+}
+
+func TestBuildAliasesCollision(t *testing.T) {
+	cases := map[string]string{
+		"alias shadows module": `
+modules:
+  node:
+    method: exec
+    exec:
+      command: /bin/true
+  node_exporter:
+    method: exec
+    aliases: [node]
+    exec:
+      command: /bin/true
+`,
+		"alias used twice": `
+modules:
+  a:
+    method: exec
+    aliases: [old]
+    exec:
+      command: /bin/true
+  b:
+    method: exec
+    aliases: [old]
+    exec:
+      command: /bin/true
+`,
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := readConfig(strings.NewReader(c))
+			if err != nil {
+				t.Fatalf("failed reading config: %v", err)
+			}
+			if err := cfg.buildAliases(); err == nil {
+				t.Fatalf("expected alias collision error")
+			}
+		})
+	}
+}
+
+func TestReadModuleConfigs(t *testing.T) {
+	mcfgs, err := readModuleConfigs(strings.NewReader(`---
+name: a
+method: exec
+exec:
+  command: /bin/true
+---
+name: b
+method: http
+http:
+  port: 9100
+---
+`))
+	if err != nil {
+		t.Fatalf("failed reading modules: %v", err)
+	}
+	if len(mcfgs) != 2 || mcfgs[0].Name != "a" || mcfgs[1].Name != "b" {
+		t.Fatalf("expected modules a and b, got %v", mcfgs)
+	}
+	if mcfgs[1].Module.name != "b" || mcfgs[1].Module.HTTP.Port != 9100 {
+		t.Fatalf("module b was not read correctly: %+v", mcfgs[1].Module)
+	}
+
+	_, err = readModuleConfigs(strings.NewReader(`
+name: a
+method: exec
+exec:
+  command: /bin/true
+---
+name: a
+method: exec
+exec:
+  command: /bin/false
+`))
+	if err == nil {
+		t.Fatalf("expected an error for a duplicate module name")
+	}
+}
+
+func TestCheckMetricPrefix(t *testing.T) {
+	for prefix, valid := range map[string]bool{
+		"tenant_":  true,
+		"ns:":      true,
+		"_private": true,
+		"__meta_":  false,
+		"1tenant":  false,
+		"ten-ant_": false,
+	} {
+		if err := checkMetricPrefix(prefix); (err == nil) != valid {
+			t.Errorf("prefix %q: expected valid %v, got error %v", prefix, valid, err)
+		}
+	}
+}
+
+func TestCheckModuleConfigURLPath(t *testing.T) {
+	for path, valid := range map[string]bool{
+		"/metrics":                   true,
+		"/probe?module=http_2xx":     true,
+		"http://example.com/metrics": false,
+		"//example.com:9100/metrics": false,
+		"https://localhost:9100/":    false,
+	} {
+		_, err := readModuleConfig("test", strings.NewReader(`
+method: http
+http:
+  port: 9100
+  path: "`+path+`"
+`))
+		if (err == nil) != valid {
+			t.Errorf("path %q: expected valid %v, got error %v", path, valid, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("node.yml", "method: exec\nexec:\n  command: /bin/true\n")
+
+	oldFile, oldDirs := *cfgFile, cfgDirs
+	*cfgFile, cfgDirs = "", StringSliceFlag{dir}
+	defer func() { *cfgFile, cfgDirs = oldFile, oldDirs }()
+
+	cfg, err := setup()
+	if err != nil {
+		t.Fatalf("failed setting up: %v", err)
+	}
+	cfg.Modules["found"] = &moduleConfig{Method: "http", discovered: true}
+	node := cfg.getModule("node")
+
+	write("other.yml", "method: exec\naliases: [alias]\nexec:\n  command: /bin/true\n")
+	if _, err := cfg.reload(); err != nil {
+		t.Fatalf("failed reloading: %v", err)
+	}
+	for _, name := range []string{"node", "other", "alias", "found"} {
+		if cfg.getModule(name) == nil {
+			t.Errorf("module %v missing after reload", name)
+		}
+	}
+	if cfg.getModule("node") == node {
+		t.Errorf("module node was not reloaded")
+	}
+	if node.Exec.Command != "/bin/true" {
+		t.Errorf("previous module config was changed")
+	}
+
+	write("broken.yml", "method: exec\nbogus: true\n")
+	if _, err := cfg.reload(); err == nil {
+		t.Fatalf("expected reloading a bad config to fail")
+	}
+	if cfg.getModule("other") == nil {
+		t.Errorf("modules were replaced by a failed reload")
+	}
+}
+
+func TestMaxModules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const module = "method: http\nhttp:\n  port: 9100\n"
+	if err := os.Mkdir(filepath.Join(dir, "modules"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldFile, oldDirs, oldMax := *cfgFile, cfgDirs, *maxModules
+	defer func() { *cfgFile, cfgDirs, *maxModules = oldFile, oldDirs, oldMax }()
+	*maxModules = 2
+
+	// A config file defining more modules than the limit fails to load.
+	write("expexp.yaml", "modules:\n  a:\n    method: http\n    http:\n      port: 9100\n"+
+		"  b:\n    method: http\n    http:\n      port: 9100\n"+
+		"  c:\n    method: http\n    http:\n      port: 9100\n")
+	*cfgFile, cfgDirs = filepath.Join(dir, "expexp.yaml"), nil
+	if _, err := setup(); err == nil || !strings.Contains(err.Error(), "-config.max-modules") {
+		t.Errorf("expected loading more modules than the limit to fail, got %v", err)
+	}
+
+	// So do directories, both when loading and reloading.
+	*cfgFile, cfgDirs = "", StringSliceFlag{filepath.Join(dir, "modules")}
+	write("modules/a.yml", module)
+	write("modules/b.yml", module)
+	cfg, err := setup()
+	if err != nil {
+		t.Fatalf("failed setting up with as many modules as the limit: %v", err)
+	}
+	write("modules/c.yml", module)
+	if _, err := cfg.reload(); err == nil || !strings.Contains(err.Error(), "-config.max-modules") {
+		t.Errorf("expected reloading more modules than the limit to fail, got %v", err)
+	}
+	if len(cfg.GetModules()) != 2 || cfg.getModule("c") != nil {
+		t.Errorf("expected the modules to be kept after the failed reload, got %v", cfg.GetModules())
+	}
+	if _, err := setup(); err == nil {
+		t.Errorf("expected loading more modules than the limit to fail")
+	}
+
+	*maxModules = 0
+	if _, err := cfg.reload(); err != nil || len(cfg.GetModules()) != 3 {
+		t.Errorf("expected no limit with -config.max-modules=0, got %v modules, %v", len(cfg.GetModules()), err)
+	}
+}
+
+func TestModuleHealthPruned(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const module = "method: http\nhttp:\n  port: 9100\n"
+	write("health_kept.yml", module)
+	write("health_dropped.yml", module)
+
+	oldFile, oldDirs := *cfgFile, cfgDirs
+	*cfgFile, cfgDirs = "", StringSliceFlag{dir}
+	defer func() { *cfgFile, cfgDirs = oldFile, oldDirs }()
+
+	cfg, err := setup()
+	if err != nil {
+		t.Fatalf("failed setting up: %v", err)
+	}
+	health := selfMetrics.moduleHealth
+	health.scraped("health_kept", true)
+	health.scraped("health_dropped", true)
+	tracked := func(name string) bool {
+		health.mutex.Lock()
+		defer health.mutex.Unlock()
+		_, ok := health.lastSuccess[name]
+		return ok
+	}
+
+	if err := os.Remove(filepath.Join(dir, "health_dropped.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.reload(); err != nil {
+		t.Fatalf("failed reloading: %v", err)
+	}
+	if tracked("health_dropped") || !tracked("health_kept") {
+		t.Errorf("expected only the module dropped by the reload to be forgotten")
+	}
+
+	cfg.removeModule("health_kept")
+	if tracked("health_kept") {
+		t.Errorf("expected the removed module to be forgotten")
+	}
+}
+
+func TestSecretsReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	module := func(token string) string {
+		return "method: http\nhttp:\n  port: 9100\n  bearer_token: 'exec://cat " + filepath.Join(dir, token) + "'\n"
+	}
+	write("a.token", "a1\n")
+	write("b.token", "b1\n")
+	if err := os.Mkdir(filepath.Join(dir, "modules"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write("modules/node.yml", module("a.token"))
+
+	oldFile, oldDirs := *cfgFile, cfgDirs
+	*cfgFile, cfgDirs = "", StringSliceFlag{filepath.Join(dir, "modules")}
+	defer func() { *cfgFile, cfgDirs = oldFile, oldDirs }()
+
+	cfg, err := setup()
+	if err != nil {
+		t.Fatalf("failed setting up: %v", err)
+	}
+	if len(cfg.secrets) != 1 || cfg.getModule("node").HTTP.bearerToken.Get() != "a1" {
+		t.Fatalf("expected the module's secret to be resolved and kept, got %v", cfg.secrets)
+	}
+
+	// Secrets the modules no longer refer to are dropped on reload.
+	write("modules/node.yml", module("b.token"))
+	if _, err := cfg.reload(); err != nil {
+		t.Fatalf("failed reloading: %v", err)
+	}
+	if len(cfg.secrets) != 1 {
+		t.Fatalf("expected only the secret in use to be kept, got %v", cfg.secrets)
+	}
+	for ref := range cfg.secrets {
+		if !strings.Contains(ref, "b.token") {
+			t.Errorf("expected the secret of b.token to be kept, got %v", ref)
+		}
+	}
+
+	// Changed secrets are swapped in with a reload, not changed in place.
+	node := cfg.getModule("node")
+	refreshSecretsOnce(context.Background(), cfg)
+	if cfg.getModule("node") != node {
+		t.Errorf("expected the modules not to be reloaded when no secret has changed")
+	}
+	write("b.token", "b2\n")
+	refreshSecretsOnce(context.Background(), cfg)
+	if got := cfg.getModule("node").HTTP.bearerToken.Get(); got != "b2" {
+		t.Errorf("expected the refreshed secret to be used, got %q", got)
+	}
+	if got := node.HTTP.bearerToken.Get(); got != "b1" {
+		t.Errorf("expected the previous module to be left as it was, got %q", got)
+	}
+}
+
+func TestSecretsDisableExec(t *testing.T) {
+	defer func(old bool) { *disableExec = old }(*disableExec)
+	*disableExec = true
+
+	ran := filepath.Join(t.TempDir(), "ran")
+	if _, err := newSecret("exec://touch " + ran); err == nil {
+		t.Errorf("expected exec secrets to be refused with -disable.exec")
+	}
+	if _, err := os.Stat(ran); !os.IsNotExist(err) {
+		t.Errorf("expected the secret's command not to be run, got %v", err)
+	}
+
+	s, err := newSecret("literal")
+	if err != nil || s.Get() != "literal" {
+		t.Errorf("expected literal secrets to be used with -disable.exec, got %v", err)
+	}
+}
+
+func TestReloadCheckBackends(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	module := func(port int, optional bool) string {
+		return fmt.Sprintf("method: http\noptional: %v\nhttp:\n  address: 127.0.0.1\n  port: %d\n", optional, port)
+	}
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	up := listen()
+	defer up.Close()
+	closed := listen()
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	write("up.yml", module(up.Addr().(*net.TCPAddr).Port, false))
+
+	oldFile, oldDirs, oldCheck := *cfgFile, cfgDirs, *checkBackends
+	*cfgFile, cfgDirs, *checkBackends = "", StringSliceFlag{dir}, time.Second
+	defer func() { *cfgFile, cfgDirs, *checkBackends = oldFile, oldDirs, oldCheck }()
+
+	cfg, err := setup()
+	if err != nil {
+		t.Fatalf("failed setting up: %v", err)
+	}
+	reload := func() (int, string) {
+		rr := httptest.NewRecorder()
+		cfg.reloadHandler(rr, httptest.NewRequest("POST", "/-/reload", nil))
+		return rr.Code, rr.Body.String()
+	}
+
+	// Unchanged backends aren't checked again, optional ones only warn.
+	up.Close()
+	write("opt.yml", module(closedPort, true))
+	code, body := reload()
+	if code != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d: %s", code, body)
+	}
+	if strings.Contains(body, "module up ") {
+		t.Errorf("expected the unchanged backend not to be checked, got %q", body)
+	}
+	if !strings.Contains(body, "optional module opt backend") {
+		t.Errorf("expected the optional backend to be reported, got %q", body)
+	}
+
+	write("down.yml", module(closedPort, false))
+	code, body = reload()
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected the reload to fail, got %d: %s", code, body)
+	}
+	if !strings.Contains(body, "\nmodule down backend") {
+		t.Errorf("expected the unreachable backend to be reported, got %q", body)
+	}
+	if strings.Contains(body, "module opt ") {
+		t.Errorf("expected the unchanged optional backend not to be checked, got %q", body)
+	}
+	if cfg.getModule("down") != nil {
+		t.Errorf("expected the failed reload to keep the previous modules")
+	}
+}
+
+func TestEnabledIf(t *testing.T) {
+	hn, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EXPEXP_TEST_ROLE", "primary")
+
+	cfg, err := readConfig(strings.NewReader(`
+modules:
+  primary:
+    method: exec
+    enabled_if:
+      env:
+        EXPEXP_TEST_ROLE: 'primary|replica'
+    exec:
+      command: /bin/true
+  replica:
+    method: exec
+    enabled_if:
+      env:
+        EXPEXP_TEST_ROLE: replica
+    exec:
+      command: /bin/true
+  this_host:
+    method: exec
+    enabled_if:
+      hostname: '` + regexp.QuoteMeta(hn) + `'
+      env:
+        EXPEXP_TEST_UNSET: ''
+    exec:
+      command: /bin/true
+  other_host:
+    method: exec
+    enabled_if:
+      hostname: 'not-` + regexp.QuoteMeta(hn) + `'
+    exec:
+      command: /bin/true
+`))
+	if err != nil {
+		t.Fatalf("failed reading config: %v", err)
+	}
+	for name, enabled := range map[string]bool{"primary": true, "replica": false, "this_host": true, "other_host": false} {
+		if (cfg.getModule(name) != nil) != enabled {
+			t.Errorf("expected module %v enabled %v", name, enabled)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	cfg.doProxy(rr, httptest.NewRequest("GET", "/proxy?module=replica", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected a disabled module to be unknown, got status %d", rr.Code)
+	}
+
+	for _, cond := range []string{"hostname: '('", "env: {ROLE: '('}", "role: primary"} {
+		_, err := readModuleConfig("bad", strings.NewReader("method: exec\nenabled_if: {"+cond+"}\nexec:\n  command: /bin/true\n"))
+		if err == nil {
+			t.Errorf("expected enabled_if {%v} to be rejected", cond)
+		}
+	}
+}
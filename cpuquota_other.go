@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// CPU quotas are only detected on linux.
+func cgroupCPUQuota() (float64, bool) {
+	return 0, false
+}
@@ -0,0 +1,235 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5" // #nosec required by the digest scheme
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// digestTransport answers the digest authentication challenges of a backend.
+// The last challenge is kept, so that only the first request, and those made
+// after the backend changes its nonce, need an extra round trip.
+type digestTransport struct {
+	next     http.RoundTripper
+	username *secret
+	password *secret
+
+	mutex     sync.Mutex
+	challenge *digestChallenge
+	nc        uint32
+}
+
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	hash      func() hash.Hash
+}
+
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	ch := t.challenge
+	t.mutex.Unlock()
+
+	authReq := req
+	if ch != nil {
+		var err error
+		if authReq, err = t.authorize(req, ch); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.next.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	newCh, err := parseDigestChallenge(resp.Header)
+	if err != nil {
+		log.Warnf("ignoring digest challenge from %v, %v", req.URL.Host, err)
+		return resp, nil
+	}
+	if newCh == nil || (ch != nil && newCh.nonce == ch.nonce) {
+		// Either not a digest challenge, or the credentials were rejected.
+		return resp, nil
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.mutex.Lock()
+	t.challenge, t.nc = newCh, 0
+	t.mutex.Unlock()
+
+	if authReq, err = t.authorize(req, newCh); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(authReq)
+}
+
+// authorize returns a copy of req with an Authorization header answering ch.
+func (t *digestTransport) authorize(req *http.Request, ch *digestChallenge) (*http.Request, error) {
+	t.mutex.Lock()
+	t.nc++
+	nc := fmt.Sprintf("%08x", t.nc)
+	t.mutex.Unlock()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed generating digest cnonce, %w", err)
+	}
+	cnonce := hex.EncodeToString(b)
+
+	h := func(s string) string {
+		hh := ch.hash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+	user, uri := t.username.Get(), req.URL.RequestURI()
+	ha1 := h(user + ":" + ch.realm + ":" + t.password.Get())
+	if strings.HasSuffix(strings.ToUpper(ch.algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	var response string
+	if ch.qop == "" {
+		response = h(ha1 + ":" + ch.nonce + ":" + ha2)
+	} else {
+		response = h(strings.Join([]string{ha1, ch.nonce, nc, cnonce, ch.qop, ha2}, ":"))
+	}
+
+	fields := []string{
+		fmt.Sprintf("username=%q", user),
+		fmt.Sprintf("realm=%q", ch.realm),
+		fmt.Sprintf("nonce=%q", ch.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+	}
+	if ch.algorithm != "" {
+		fields = append(fields, "algorithm="+ch.algorithm)
+	}
+	if ch.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", ch.opaque))
+	}
+	if ch.qop != "" {
+		fields = append(fields, "qop="+ch.qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+
+	r := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	r.Header.Set("Authorization", "Digest "+strings.Join(fields, ", "))
+	return r, nil
+}
+
+// parseDigestChallenge returns the digest challenge in the WWW-Authenticate
+// headers, or nil if there is none.
+func parseDigestChallenge(h http.Header) (*digestChallenge, error) {
+	for _, v := range h.Values("WWW-Authenticate") {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		params := parseDigestParams(rest)
+		ch := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		if ch.nonce == "" {
+			return nil, fmt.Errorf("digest challenge has no nonce")
+		}
+
+		switch strings.ToUpper(ch.algorithm) {
+		case "", "MD5", "MD5-SESS":
+			ch.hash = md5.New
+		case "SHA-256", "SHA-256-SESS":
+			ch.hash = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported digest algorithm %v", ch.algorithm)
+		}
+
+		if qop, ok := params["qop"]; ok {
+			for _, q := range strings.Split(qop, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					ch.qop = "auth"
+				}
+			}
+			if ch.qop == "" {
+				return nil, fmt.Errorf("unsupported digest qop %v", qop)
+			}
+		}
+		return ch, nil
+	}
+	return nil, nil
+}
+
+// parseDigestParams parses the comma separated key=value pairs of a digest
+// challenge or response, whose values may be quoted.
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			v, after, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(v))
+			s = after
+		}
+		params[key] = value.String()
+	}
+}
@@ -5,29 +5,104 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// probeLimiter caps the number of discovery probes running at once, and the
+// rate at which they start, across all discovery sources.
+type probeLimiter struct {
+	slots    chan struct{} // nil if unlimited
+	interval time.Duration // 0 if unlimited
+
+	mutex sync.Mutex
+	next  time.Time
+}
+
+func newProbeLimiter(concurrency int, rate float64) *probeLimiter {
+	l := &probeLimiter{}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	if rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return l
+}
+
+// acquire waits until a probe may start, returning false if ctx is done
+// first. Probes that were started must be followed by a call to release.
+func (l *probeLimiter) acquire(ctx context.Context) bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if l.interval > 0 {
+		l.mutex.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(l.interval)
+		l.mutex.Unlock()
+
+		select {
+		case <-time.After(time.Until(start)):
+		case <-ctx.Done():
+			l.release()
+			return false
+		}
+	}
+
+	selfMetrics.discoveryProbesInFlight.Inc()
+	return true
+}
+
+func (l *probeLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
 var client = &http.Client{
 	Transport: &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec only cockroach at the moment
 	},
 }
 
-func alive(parentCtx context.Context, host string, portI int, path string) bool {
+// alive probes an exporter, giving up after timeout. If timeout is 0, TCP
+// probes wait 200ms and HTTP probes 3s.
+func alive(parentCtx context.Context, host string, portI int, path string, timeout time.Duration) bool {
 	port := strconv.Itoa(portI)
 	if path != "" { // Try http if we have a path configured.
-		return alivePath(parentCtx, host, port, path)
+		if timeout == 0 {
+			timeout = 3 * time.Second
+		}
+		return alivePath(parentCtx, host, port, path, timeout)
 	}
 
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 200*time.Millisecond)
+	if timeout == 0 {
+		timeout = 200 * time.Millisecond
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
 	if err != nil {
 		return false
 	}
@@ -40,10 +115,10 @@ func alive(parentCtx context.Context, host string, portI int, path string) bool
 }
 
 // alivePath connects over HTTP and checks that the output contains # TYPE so its valid metrics.
-func alivePath(parentCtx context.Context, host, port, path string) bool {
+func alivePath(parentCtx context.Context, host, port, path string, timeout time.Duration) bool {
 	u := fmt.Sprintf(path, net.JoinHostPort(host, port))
 
-	ctx, cancel := context.WithTimeout(parentCtx, time.Second*3)
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
@@ -69,40 +144,148 @@ func alivePath(parentCtx context.Context, host, port, path string) bool {
 	return false
 }
 
+// discoverOnce runs a single discovery cycle, and writes a file_sd file for
+// all of the modules to path, or to stdout if path is empty.
+func discoverOnce(ctx context.Context, cfg *config, path, target string) error {
+	if cfg.Modules == nil {
+		cfg.Modules = make(map[string]*moduleConfig)
+	}
+	if cfg.Discovery.Enabled {
+		runDiscovery(ctx, cfg, newProbeLimiter(*discoveryMaxProbes, *discoveryProbeRate))
+	}
+
+	if cfg.proxyPath == "" {
+		return errors.New("can't write file_sd targets with proxying disabled")
+	}
+	groups := cfg.targetGroups(target, "")
+	if len(groups) == 0 {
+		return errors.New("no modules configured or discovered")
+	}
+	bs, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+
+	if path == "" {
+		_, err = os.Stdout.Write(bs)
+		return err
+	}
+
+	// Write via a temporary file, so that prometheus never reads a
+	// partially written file.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return fmt.Errorf("failed writing file_sd file, %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed writing file_sd file, %w", err)
+	}
+	return nil
+}
+
 func startDiscovery(ctx context.Context, cfg *config) {
 	if cfg.Modules == nil { // make sure we have modules config if we are running only in discovery mode
 		cfg.Modules = make(map[string]*moduleConfig)
 	}
+	limiter := newProbeLimiter(*discoveryMaxProbes, *discoveryProbeRate)
 	ticker := time.NewTicker(cfg.Discovery.interval)
-	runDiscovery(ctx, cfg)
+	runDiscovery(ctx, cfg, limiter)
+	atomic.StoreInt32(&cfg.loaded, 1)
 	for {
 		select {
 		case <-ticker.C:
-			runDiscovery(ctx, cfg)
+			runDiscovery(ctx, cfg, limiter)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func runDiscovery(ctx context.Context, cfg *config) {
+// probeExporters probes the exporters not yet added as modules, at most
+// ProbeConcurrency at a time and within the limits of limiter, returning the
+// names of those that are alive.
+func probeExporters(ctx context.Context, cfg *config, limiter *probeLimiter) []string {
 	ip := cfg.Discovery.Address
+	concurrency := cfg.Discovery.ProbeConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		live  []string
+	)
+	slots := make(chan struct{}, concurrency)
 	for name, exp := range cfg.Discovery.Exporters {
 		if m := cfg.getModule(name); m != nil {
 			continue
 		}
-		if !alive(ctx, ip, exp.Port, exp.Path) {
-			logrus.Debugf("%s:%d was not open", ip, exp.Port)
-			continue
-		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(name string, exp *exporter) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if !limiter.acquire(ctx) {
+				return
+			}
+			defer func() {
+				selfMetrics.discoveryProbesInFlight.Dec()
+				limiter.release()
+			}()
+			if !alive(ctx, ip, exp.Port, exp.Path, cfg.Discovery.ProbeTimeout) {
+				logrus.Debugf("%s:%d was not open", ip, exp.Port)
+				return
+			}
+			mutex.Lock()
+			live = append(live, name)
+			mutex.Unlock()
+		}(name, exp)
+	}
+	wg.Wait()
+	sort.Strings(live)
+	return live
+}
+
+func runDiscovery(ctx context.Context, cfg *config, limiter *probeLimiter) {
+	switch cfg.Discovery.Type {
+	case discoveryTypeKubernetes:
+		runKubernetesDiscovery(ctx, cfg)
+		return
+	case discoveryTypeDocker:
+		runDockerDiscovery(ctx, cfg)
+		return
+	}
+	ip := cfg.Discovery.Address
+	for _, name := range probeExporters(ctx, cfg, limiter) {
+		exp := cfg.Discovery.Exporters[name]
 
 		mc := &moduleConfig{
-			Method: "http",
+			Method:     "http",
+			Timeout:    *defaultTimeout,
+			discovered: true,
 			HTTP: httpConfig{
 				Port:    exp.Port,
 				Address: cfg.Discovery.Address,
 			},
 		}
+		for l, v := range exp.Labels {
+			if v.Inject {
+				if mc.InjectLabels == nil {
+					mc.InjectLabels = make(map[string]string)
+				}
+				mc.InjectLabels[l] = v.Value
+				continue
+			}
+			if mc.labels == nil {
+				mc.labels = make(map[string]string)
+			}
+			mc.labels[l] = v.Value
+		}
 
 		if exp.Path != "" {
 			u, err := url.Parse(fmt.Sprintf(exp.Path, net.JoinHostPort(ip, strconv.Itoa(exp.Port))))
@@ -118,7 +301,52 @@ func runDiscovery(ctx context.Context, cfg *config) {
 		if err != nil {
 			logrus.Error(err)
 		}
-		cfg.addModule(name, mc)
+		if err := cfg.addModule(name, mc); err != nil {
+			logrus.Error(err)
+			return
+		}
+		initModuleMetrics(mc)
 		continue
 	}
 }
+
+// syncDiscoveredModules makes the discovered modules those of modules, found
+// by listing the objects of kind, such as pods or containers: new ones are
+// added, those whose backend has changed are replaced, and discovered modules
+// not in modules are removed. A module named like a configured one is
+// skipped.
+func syncDiscoveredModules(cfg *config, modules map[string]*moduleConfig, kind string) {
+	found := make(map[string]bool)
+	for name, mc := range modules {
+		if err := checkModuleConfig(name, mc); err != nil {
+			logrus.Errorf("skipping %v %v, %v", kind, name, err)
+			continue
+		}
+		old := cfg.getModule(name)
+		if old != nil && !old.discovered {
+			logrus.Warnf("skipping %v %v, a module of that name is already configured", kind, name)
+			continue
+		}
+		found[name] = true
+		if old != nil {
+			if old.backend() == mc.backend() {
+				continue
+			}
+			// The object was replaced, and has a new address.
+			cfg.removeModule(name)
+		}
+		if err := cfg.addModule(name, mc); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		logrus.Infof("discovered module %v from %v, scraping %v", name, kind, mc.backend())
+		initModuleMetrics(mc)
+	}
+
+	for name, m := range cfg.GetModules() {
+		if m.discovered && !found[name] {
+			logrus.Infof("removing module %v, its %v is gone", name, kind)
+			cfg.removeModule(name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const dnsRefreshTimeout = 10 * time.Second
+
+// dnsCache resolves backend host names and remembers the results for ttl.
+// Once an entry is older than ttl it is still used, while being refreshed in
+// the background, until it is older than ttl+grace. This keeps a backend
+// reachable while its name temporarily fails to resolve.
+type dnsCache struct {
+	ttl   time.Duration
+	grace time.Duration
+
+	resolver *net.Resolver
+	dialer   *net.Dialer
+
+	mutex   sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs      []string
+	resolved   time.Time
+	refreshing bool
+}
+
+func newDNSCache(ttl, grace time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:      ttl,
+		grace:    grace,
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{},
+		entries:  make(map[string]*dnsCacheEntry),
+	}
+}
+
+// DialContext is suitable for use as the DialContext of an http.Transport.
+func (c *dnsCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mutex.Lock()
+	if e, ok := c.entries[host]; ok {
+		age := time.Since(e.resolved)
+		if age < c.ttl+c.grace {
+			if age >= c.ttl && !e.refreshing {
+				e.refreshing = true
+				go c.refresh(host)
+			}
+			addrs := e.addrs
+			c.mutex.Unlock()
+			return addrs, nil
+		}
+	}
+	c.mutex.Unlock()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.store(host, addrs)
+	return addrs, nil
+}
+
+func (c *dnsCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+	defer cancel()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		log.Warnf("failed refreshing cached address of %s, %v", host, err)
+		c.mutex.Lock()
+		if e, ok := c.entries[host]; ok {
+			e.refreshing = false
+		}
+		c.mutex.Unlock()
+		return
+	}
+	c.store(host, addrs)
+}
+
+func (c *dnsCache) store(host string, addrs []string) {
+	c.mutex.Lock()
+	c.entries[host] = &dnsCacheEntry{
+		addrs:    addrs,
+		resolved: time.Now(),
+	}
+	c.mutex.Unlock()
+}
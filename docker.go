@@ -0,0 +1,185 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	discoveryTypeDocker = "docker"
+
+	dockerPortLabel   = "prometheus.port"
+	dockerPathLabel   = "prometheus.path"
+	dockerSchemeLabel = "prometheus.scheme"
+)
+
+// dockerDiscoveryConfig configures the discovery of labelled containers from
+// the docker engine API.
+type dockerDiscoveryConfig struct {
+	Host    string                 `yaml:"host"`    // unix:///var/run/docker.sock
+	Network string                 `yaml:"network"` // the first with an address
+	XXX     map[string]interface{} `yaml:",inline"`
+
+	client  *http.Client
+	baseURL string
+}
+
+func checkDockerDiscoveryConfig(c *dockerDiscoveryConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown docker discovery fields: %v", c.XXX)
+	}
+	if c.Host == "" {
+		c.Host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(c.Host)
+	if err != nil {
+		return fmt.Errorf("bad docker host, %w", err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		c.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+		c.baseURL = "http://docker"
+	case "tcp", "http":
+		c.client = &http.Client{}
+		c.baseURL = "http://" + u.Host
+	default:
+		return fmt.Errorf("docker host %q must be a unix, tcp or http url", c.Host)
+	}
+	return nil
+}
+
+type dockerContainer struct {
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// containers lists the running containers that have the port label.
+func (c *dockerDiscoveryConfig) containers(ctx context.Context) ([]dockerContainer, error) {
+	filters, _ := json.Marshal(map[string][]string{"label": {dockerPortLabel}})
+	u := c.baseURL + "/containers/json?" + url.Values{"filters": {string(filters)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing containers failed with status %v", resp.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed decoding containers, %w", err)
+	}
+	return containers, nil
+}
+
+// address returns the IP address of the container on network, or on the
+// first of its networks, by name, that gives it one. Containers without one,
+// such as those using the host's network, are reached on localhost.
+func (c *dockerDiscoveryConfig) address(ctr dockerContainer) string {
+	networks := ctr.NetworkSettings.Networks
+	if c.Network != "" {
+		return networks[c.Network].IPAddress
+	}
+	var names []string
+	for n := range networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if ip := networks[n].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return "localhost"
+}
+
+// containerModule returns the module scraping a labelled container.
+func (c *dockerDiscoveryConfig) containerModule(ctr dockerContainer) (*moduleConfig, error) {
+	port := ctr.Labels[dockerPortLabel]
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return nil, fmt.Errorf("bad %v label %q", dockerPortLabel, port)
+	}
+	address := c.address(ctr)
+	if address == "" {
+		return nil, fmt.Errorf("container has no address on network %v", c.Network)
+	}
+
+	return &moduleConfig{
+		Method:     "http",
+		Timeout:    *defaultTimeout,
+		discovered: true,
+		HTTP: httpConfig{
+			Address: address,
+			Port:    p,
+			Path:    ctr.Labels[dockerPathLabel],
+			Scheme:  ctr.Labels[dockerSchemeLabel],
+		},
+	}, nil
+}
+
+// runDockerDiscovery adds a module for every labelled container, named after
+// the container, and removes the modules of containers that are gone.
+func runDockerDiscovery(ctx context.Context, cfg *config) {
+	dc := cfg.Discovery.Docker
+	containers, err := dc.containers(ctx)
+	if err != nil {
+		logrus.Errorf("docker discovery failed, %v", err)
+		return
+	}
+
+	modules := make(map[string]*moduleConfig)
+	for _, ctr := range containers {
+		if len(ctr.Names) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(ctr.Names[0], "/")
+		mc, err := dc.containerModule(ctr)
+		if err != nil {
+			logrus.Errorf("skipping container %v, %v", name, err)
+			continue
+		}
+		mc.labels = map[string]string{"container": name}
+		modules[name] = mc
+	}
+	syncDiscoveredModules(cfg, modules, "container")
+}
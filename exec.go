@@ -16,10 +16,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -28,80 +35,370 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	cmdStartsCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_command_starts_total",
-			Help: "Counts of command starts",
-		},
-		[]string{"module"},
-	)
-	cmdFailsCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_command_fails_total",
-			Help: "Count of commands with non-zero exits",
-		},
-		[]string{"module"},
-	)
-)
+// execSlots limits the number of commands running at once, across all
+// modules. It is nil if there is no limit.
+var execSlots chan struct{}
 
-func (c execConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
-	return func() ([]*dto.MetricFamily, error) {
-		var out bytes.Buffer
+// setupExecLimit limits the number of commands running at once to max, or if
+// max is 0, to twice the number of CPUs available.
+func setupExecLimit(max int) {
+	if max < 0 {
+		execSlots = nil
+		return
+	}
+	if max == 0 {
+		max = 2 * availableCPUs()
+	}
+	log.Debugf("limiting exec modules to %d commands at once", max)
+	execSlots = make(chan struct{}, max)
+}
+
+// availableCPUs returns GOMAXPROCS, reduced to the CPU quota of the cgroup if
+// that is lower and GOMAXPROCS wasn't set explicitly.
+func availableCPUs() int {
+	n := runtime.GOMAXPROCS(0)
+	if os.Getenv("GOMAXPROCS") != "" {
+		return n
+	}
+	if quota, ok := cgroupCPUQuota(); ok {
+		if q := int(math.Ceil(quota)); q < n {
+			n = q
+		}
+	}
+	return n
+}
+
+// run runs the command, writing its standard output to stdout.
+func (c execConfig) run(ctx context.Context, r *http.Request, stdout io.Writer) error {
+	cmd := exec.CommandContext(ctx, c.Command)
+	cmd.Args = append(cmd.Args, c.Args...)
+	uargs, ok := r.URL.Query()["args"]
+	if ok {
+		cmd.Args = append(cmd.Args, uargs...)
+	}
+
+	if len(c.Env) == 0 {
+		cmd.Env = os.Environ()
+	}
+	for k, v := range c.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	cmd.Env = append(cmd.Env, c.scrapeEnv(ctx)...)
 
-		cmd := exec.CommandContext(ctx, c.Command)
-		cmd.Args = append(cmd.Args, c.Args...)
-		uargs, ok := r.URL.Query()["args"]
-		if ok {
-			cmd.Args = append(cmd.Args, uargs...)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+
+	if execSlots != nil {
+		select {
+		case execSlots <- struct{}{}:
+			defer func() { <-execSlots }()
+		case <-ctx.Done():
+			log.Warnf("Command module %v timed out waiting for one of %d commands to complete (-exec.max-processes)", c.mcfg.name, cap(execSlots))
+			selfMetrics.cmdFailsCount.WithLabelValues(c.mcfg.name).Inc()
+			selfMetrics.proxyTimeoutCount.WithLabelValues(c.mcfg.name).Inc()
+			return ctx.Err()
 		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		selfMetrics.cmdStartsCount.WithLabelValues(c.mcfg.name).Inc()
+		errc <- cmd.Run()
+		close(errc)
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+		err = c.checkExit(err)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
 
-		for k, v := range c.Env {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	if err != nil {
+		log.Warnf("Command module %v failed %+v", c.mcfg.name, err)
+		selfMetrics.cmdFailsCount.WithLabelValues(c.mcfg.name).Inc()
+		if err == context.DeadlineExceeded {
+			selfMetrics.proxyTimeoutCount.WithLabelValues(c.mcfg.name).Inc()
 		}
+	}
+	return err
+}
 
-		cmd.Stdout = &out
-		cmd.Stderr = os.Stderr
+// runRetrying runs the command, re-running it after a failure up to Retries
+// times while there is time left and retry, which should discard any partial
+// output, reports that it is possible.
+func (c execConfig) runRetrying(ctx context.Context, r *http.Request, stdout io.Writer, retry func() bool) error {
+	for attempt := 0; ; attempt++ {
+		err := c.run(ctx, r, stdout)
+		if err == nil || attempt >= c.Retries || ctx.Err() != nil || !retry() {
+			return err
+		}
 
-		errc := make(chan error, 1)
-		go func() {
-			cmdStartsCount.WithLabelValues(c.mcfg.name).Inc()
-			errc <- cmd.Run()
-			close(errc)
-		}()
+		// Don't wait for a retry that couldn't start before the scrape
+		// times out.
+		delay := c.retryDelay()
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			log.Debugf("Not retrying command module %v, the scrape times out before the next attempt", c.mcfg.name)
+			return err
+		}
 
-		var err error
 		select {
-		case err = <-errc:
+		case <-time.After(delay):
 		case <-ctx.Done():
-			err = ctx.Err()
+			return err
 		}
+		log.Debugf("Retrying command module %v", c.mcfg.name)
+		selfMetrics.cmdRetriesCount.WithLabelValues(c.mcfg.name).Inc()
+	}
+}
 
-		if err != nil {
-			log.Warnf("Command module %v failed %+v", c.mcfg.name, err)
-			cmdFailsCount.WithLabelValues(c.mcfg.name).Inc()
-			if err == context.DeadlineExceeded {
-				proxyTimeoutCount.WithLabelValues(c.mcfg.name).Inc()
-			}
+// retryDelay returns RetryBackoff with up to half as much again added at
+// random, so that commands failing together do not retry in lockstep.
+func (c execConfig) retryDelay() time.Duration {
+	if c.RetryBackoff <= 0 {
+		return 0
+	}
+	return c.RetryBackoff + time.Duration(rand.Int63n(int64(c.RetryBackoff)/2+1))
+}
+
+// scrapeEnv returns the environment variables describing the scrape that are
+// set for every command.
+func (c execConfig) scrapeEnv(ctx context.Context) []string {
+	env := []string{"EXPEXP_MODULE=" + c.mcfg.name}
+	if dl, ok := ctx.Deadline(); ok {
+		env = append(env, fmt.Sprintf("EXPEXP_TIMEOUT_SECONDS=%.3f", time.Until(dl).Seconds()))
+	}
+	return env
+}
+
+func (c execConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		var out bytes.Buffer
+
+		retry := func() bool {
+			out.Reset()
+			return true
+		}
+		if err := c.runRetrying(ctx, r, &out, retry); err != nil {
 			return nil, err
 		}
+		if c.mcfg.FilterCommand != nil {
+			filtered, err := c.mcfg.FilterCommand.filter(ctx, c.mcfg.name, out.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			out.Reset()
+			out.Write(filtered)
+		}
+
 		var prsr expfmt.TextParser
 
 		var result []*dto.MetricFamily
 		mfs, err := prsr.TextToMetricFamilies(&out)
 		if err != nil {
-			proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
+			selfMetrics.proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
 			return nil, err
 		}
+		samples := 0
 		for _, mf := range mfs {
 			result = append(result, mf)
+			samples += len(mf.Metric)
+		}
+		if c.mcfg.FailOnEmpty && samples == 0 {
+			selfMetrics.proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
+			return nil, errors.New("command output contains no samples")
+		}
+		if c.mcfg.rewrites() {
+			result = c.mcfg.rewriteMetricFamilies(result)
 		}
 		return result, nil
 	}
 }
 
+// serveStream passes the output of the command on to the scraper as it is
+// produced, without validating it.
+func (c execConfig) serveStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+
+	c.mcfg.setCacheHeaders(w.Header())
+	fw := &flushWriter{w: w, interval: c.FlushInterval}
+	err := c.runRetrying(ctx, r, fw, func() bool { return !fw.written() })
+	wrote := fw.close()
+	if err == nil {
+		return
+	}
+	if wrote {
+		log.Warnf("Command module %v failed after part of its output was sent", c.mcfg.name)
+		selfMetrics.proxyPartialCount.WithLabelValues(c.mcfg.name).Inc()
+		return
+	}
+	w.Header().Del("Cache-Control")
+	w.Header().Del("Expires")
+
+	if ctx.Err() == context.DeadlineExceeded && c.mcfg.TimeoutResponse == timeoutResponseEmptyOK {
+		writeMetricFamilies(w, moduleUpFamily(c.mcfg.name, 0))
+		return
+	}
+	if c.mcfg.OnError != nil {
+		c.mcfg.OnError.write(w)
+		return
+	}
+	http.Error(w, fmt.Sprintf("command failed, %v", err), http.StatusInternalServerError)
+}
+
+// flushWriter writes to an http.ResponseWriter, flushing it after every write
+// unless it was flushed less than interval ago, in which case the flush is
+// made once interval has passed. Writes after close are discarded.
+type flushWriter struct {
+	w        http.ResponseWriter
+	interval time.Duration
+
+	mutex     sync.Mutex
+	lastFlush time.Time
+	pending   *time.Timer // flushes the writes held back by interval
+	wrote     bool
+	closed    bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.closed {
+		return 0, errors.New("response already completed")
+	}
+
+	fw.wrote = true
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if wait := fw.interval - time.Since(fw.lastFlush); wait > 0 {
+		if fw.pending == nil {
+			fw.pending = time.AfterFunc(wait, fw.flushPending)
+		}
+		return n, nil
+	}
+	return n, fw.flush()
+}
+
+// flush flushes the response, if the writer supports it. fw.mutex must be
+// held.
+func (fw *flushWriter) flush() error {
+	fw.lastFlush = time.Now()
+	if err := http.NewResponseController(fw.w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (fw *flushWriter) flushPending() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.pending = nil
+	if fw.closed {
+		return
+	}
+	if err := fw.flush(); err != nil {
+		log.Debugf("failed flushing the response, %v", err)
+	}
+}
+
+// written reports whether anything has been written.
+func (fw *flushWriter) written() bool {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return fw.wrote
+}
+
+// close stops any further writes, and reports whether anything was written.
+func (fw *flushWriter) close() bool {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.closed = true
+	if fw.pending != nil {
+		fw.pending.Stop()
+		fw.pending = nil
+	}
+	return fw.wrote
+}
+
+// cacheHeaderWriter adds the module's cache headers to successful responses.
+type cacheHeaderWriter struct {
+	http.ResponseWriter
+	mcfg        *moduleConfig
+	wroteHeader bool
+}
+
+func (w *cacheHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status == http.StatusOK {
+			w.mcfg.setCacheHeaders(w.Header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheHeaderWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// checkExit returns nil if the command completed with one of the configured
+// success exit codes.
+func (c execConfig) checkExit(err error) error {
+	code := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return err
+		}
+		code = exitErr.ExitCode()
+	}
+
+	codes := c.SuccessExitCodes
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+	for _, sc := range codes {
+		if code == sc {
+			if code != 0 {
+				log.Debugf("Command module %v exited with success exit code %d", c.mcfg.name, code)
+			}
+			return nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	return err
+}
+
 func (c execConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.Stream {
+		c.serveStream(w, r)
+		return
+	}
+
 	ctx := r.Context()
-	g := c.GatherWithContext(ctx, r)
-	promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	mfs, err := c.GatherWithContext(ctx, r)()
+	if err != nil {
+		// Synthetic responses are written without the cache headers, as they
+		// stand in for a failed scrape.
+		if ctx.Err() == context.DeadlineExceeded && c.mcfg.TimeoutResponse == timeoutResponseEmptyOK {
+			writeMetricFamilies(w, moduleUpFamily(c.mcfg.name, 0))
+			return
+		}
+		if c.mcfg.OnError != nil {
+			c.mcfg.OnError.write(w)
+			return
+		}
+	}
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, err })
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(&cacheHeaderWriter{ResponseWriter: w, mcfg: c.mcfg}, r)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExecRetriesWithinTimeout(t *testing.T) {
+	modCfg := &moduleConfig{
+		Method:  "exec",
+		Timeout: 300 * time.Millisecond,
+		Exec: execConfig{
+			Command:      "false",
+			Retries:      100,
+			RetryBackoff: 50 * time.Millisecond,
+		},
+	}
+	if err := checkModuleConfig("retry_budget", modCfg); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+
+	startsBefore := testutil.ToFloat64(selfMetrics.cmdStartsCount.WithLabelValues("retry_budget"))
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	modCfg.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=retry_budget", nil))
+	took := time.Since(start)
+
+	if rr.Code == http.StatusOK {
+		t.Fatalf("expected the scrape to fail")
+	}
+	if took > modCfg.Timeout+200*time.Millisecond {
+		t.Fatalf("expected retries to stop at the module timeout of %v, took %v", modCfg.Timeout, took)
+	}
+	starts := testutil.ToFloat64(selfMetrics.cmdStartsCount.WithLabelValues("retry_budget")) - startsBefore
+	if starts < 2 || starts > 7 {
+		t.Fatalf("expected a few attempts within the timeout, got %v", starts)
+	}
+}
+
+// flushRecorder counts the flushes of a response.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int32
+}
+
+func (r *flushRecorder) Flush() {
+	atomic.AddInt32(&r.flushes, 1)
+}
+
+func TestFlushWriter(t *testing.T) {
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	fw := &flushWriter{w: rec, interval: 50 * time.Millisecond}
+
+	fw.Write([]byte("a 1\n"))
+	if n := atomic.LoadInt32(&rec.flushes); n != 1 {
+		t.Fatalf("expected the first write to be flushed, got %d flushes", n)
+	}
+	fw.Write([]byte("b 1\n"))
+	fw.Write([]byte("c 1\n"))
+	if n := atomic.LoadInt32(&rec.flushes); n != 1 {
+		t.Fatalf("expected writes within the interval to be held back, got %d flushes", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&rec.flushes); n != 2 {
+		t.Fatalf("expected the held back writes to be flushed once, got %d flushes", n)
+	}
+
+	fw.Write([]byte("d 1\n"))
+	fw.Write([]byte("e 1\n"))
+	if !fw.close() {
+		t.Errorf("expected close to report the writes")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&rec.flushes); n != 3 {
+		t.Errorf("expected no flushes after close, got %d flushes", n)
+	}
+	if _, err := fw.Write([]byte("f 1\n")); err == nil {
+		t.Errorf("expected writes after close to fail")
+	}
+	if got := rec.Body.String(); got != "a 1\nb 1\nc 1\nd 1\ne 1\n" {
+		t.Errorf("unexpected body %q", got)
+	}
+
+	// Writers that can't flush are written to all the same.
+	var w struct{ http.ResponseWriter }
+	w.ResponseWriter = httptest.NewRecorder()
+	fw = &flushWriter{w: w}
+	if _, err := fw.Write([]byte("a 1\n")); err != nil {
+		t.Errorf("expected writing without flushing to succeed, got %v", err)
+	}
+}
+
+func TestSuccessExitCodes(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		codes  []int
+		status int
+	}{
+		{"default", "echo 'x 1'", nil, http.StatusOK},
+		{"default non-zero", "echo 'x 1'; exit 2", nil, http.StatusInternalServerError},
+		{"listed", "echo 'x 1'; exit 2", []int{0, 2}, http.StatusOK},
+		{"zero not listed", "echo 'x 1'", []int{2}, http.StatusInternalServerError},
+		{"not listed", "echo 'x 1'; exit 3", []int{0, 2}, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			name := "exit_codes_" + strings.ReplaceAll(c.name, " ", "_")
+			m := &moduleConfig{
+				Method:  "exec",
+				Timeout: 5 * time.Second,
+				Exec: execConfig{
+					Command:          "sh",
+					Args:             []string{"-c", c.script},
+					SuccessExitCodes: c.codes,
+				},
+			}
+			if err := checkModuleConfig(name, m); err != nil {
+				t.Fatalf("Failed to check module config: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy", nil))
+			if rr.Code != c.status {
+				t.Fatalf("expected status %d, got %d", c.status, rr.Code)
+			}
+			fails := testutil.ToFloat64(selfMetrics.cmdFailsCount.WithLabelValues(name))
+			if ok := c.status == http.StatusOK; ok != (fails == 0) {
+				t.Errorf("expected success %v, got %v command failures", ok, fails)
+			}
+			if c.status == http.StatusOK && !strings.Contains(rr.Body.String(), "x 1") {
+				t.Errorf("expected the output to be served, got %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestExecRetries(t *testing.T) {
+	// The script counts its runs in a file, and fails the first time.
+	count := filepath.Join(t.TempDir(), "runs")
+	script := `n=$(cat "$RUNS" 2>/dev/null || echo 0); echo $((n+1)) > "$RUNS"; ` +
+		`[ "$n" -ge 1 ] && echo "x $n"`
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream %v", stream), func(t *testing.T) {
+			os.Remove(count)
+			name := fmt.Sprintf("exec_retries_%v", stream)
+			m := &moduleConfig{
+				Method:  "exec",
+				Timeout: 5 * time.Second,
+				Exec: execConfig{
+					Command:      "sh",
+					Args:         []string{"-c", script},
+					Env:          map[string]string{"RUNS": count, "PATH": os.Getenv("PATH")},
+					Stream:       stream,
+					Retries:      2,
+					RetryBackoff: 10 * time.Millisecond,
+				},
+			}
+			if err := checkModuleConfig(name, m); err != nil {
+				t.Fatalf("Failed to check module config: %v", err)
+			}
+
+			startsBefore := testutil.ToFloat64(selfMetrics.cmdStartsCount.WithLabelValues(name))
+			retriesBefore := testutil.ToFloat64(selfMetrics.cmdRetriesCount.WithLabelValues(name))
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy", nil))
+			if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "x 1") {
+				t.Fatalf("expected the retried command's output, got %d %q", rr.Code, rr.Body.String())
+			}
+			if n := testutil.ToFloat64(selfMetrics.cmdStartsCount.WithLabelValues(name)) - startsBefore; n != 2 {
+				t.Errorf("expected 2 command starts, got %v", n)
+			}
+			if n := testutil.ToFloat64(selfMetrics.cmdRetriesCount.WithLabelValues(name)) - retriesBefore; n != 1 {
+				t.Errorf("expected 1 retry, got %v", n)
+			}
+		})
+	}
+
+	// Once output has been streamed to the scraper the command isn't retried.
+	m := &moduleConfig{
+		Method:  "exec",
+		Timeout: 5 * time.Second,
+		Exec: execConfig{
+			Command: "sh",
+			Args:    []string{"-c", `echo "x 1"; exit 1`},
+			Stream:  true,
+			Retries: 2,
+		},
+	}
+	if err := checkModuleConfig("exec_retries_streamed", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	startsBefore := testutil.ToFloat64(selfMetrics.cmdStartsCount.WithLabelValues("exec_retries_streamed"))
+	partialBefore := testutil.ToFloat64(selfMetrics.proxyPartialCount.WithLabelValues("exec_retries_streamed"))
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/proxy", nil))
+	if n := testutil.ToFloat64(selfMetrics.cmdStartsCount.WithLabelValues("exec_retries_streamed")) - startsBefore; n != 1 {
+		t.Errorf("expected no retries after output was streamed, got %v starts", n)
+	}
+	if n := testutil.ToFloat64(selfMetrics.proxyPartialCount.WithLabelValues("exec_retries_streamed")) - partialBefore; n != 1 {
+		t.Errorf("expected the partial response to be counted, got %v", n)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// federateConfig configures a module that merges the metrics of several
+// upstream metrics endpoints, such as those of other exporter_exporters.
+type federateConfig struct {
+	Upstreams             []*federateUpstream    `yaml:"upstreams"`                // no default
+	HonorLabels           bool                   `yaml:"honor_labels"`             // false
+	FanoutConcurrency     int                    `yaml:"fanout_concurrency"`       // no limit
+	TLSInsecureSkipVerify bool                   `yaml:"tls_insecure_skip_verify"` // false
+	XXX                   map[string]interface{} `yaml:",inline"`
+
+	client *http.Client
+	mcfg   *moduleConfig
+}
+
+type federateUpstream struct {
+	Name   string                 `yaml:"name"`   // host:port of the url
+	URL    string                 `yaml:"url"`    // no default
+	Labels map[string]string      `yaml:"labels"` // no labels
+	XXX    map[string]interface{} `yaml:",inline"`
+}
+
+func checkFederateConfig(c *federateConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown federate module configuration fields: %v", c.XXX)
+	}
+	if len(c.Upstreams) == 0 {
+		return errors.New("federate modules must have at least one upstream")
+	}
+	if c.FanoutConcurrency < 0 {
+		return errors.New("fanout_concurrency must not be negative")
+	}
+
+	names := make(map[string]bool)
+	for _, u := range c.Upstreams {
+		if len(u.XXX) != 0 {
+			return fmt.Errorf("unknown federate upstream configuration fields: %v", u.XXX)
+		}
+		pu, err := url.Parse(u.URL)
+		if err != nil {
+			return fmt.Errorf("bad upstream url, %w", err)
+		}
+		if pu.Scheme != "http" && pu.Scheme != "https" || pu.Host == "" {
+			return fmt.Errorf("upstream url %q must be an absolute http or https url", u.URL)
+		}
+		if u.Name == "" {
+			u.Name = pu.Host
+		}
+		if names[u.Name] {
+			return fmt.Errorf("upstream %v is defined more than once", u.Name)
+		}
+		names[u.Name] = true
+
+		for l := range u.Labels {
+			if err := checkLabelName(l); err != nil {
+				return fmt.Errorf("bad labels for upstream %v, %w", u.Name, err)
+			}
+			if l == "upstream" {
+				return fmt.Errorf("upstream %v can't set the upstream label", u.Name)
+			}
+		}
+	}
+
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}, // #nosec configurable
+			DialContext:     checkedDial((&net.Dialer{}).DialContext, net.DefaultResolver.LookupHost),
+		},
+	}
+	return nil
+}
+
+func (c federateConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mfs := c.gather(r.Context())
+	g := func() ([]*dto.MetricFamily, error) { return mfs, nil }
+	promhttp.HandlerFor(prometheus.GathererFunc(g), promhttp.HandlerOpts{}).ServeHTTP(&cacheHeaderWriter{ResponseWriter: w, mcfg: c.mcfg}, r)
+}
+
+// gather scrapes the upstreams, FanoutConcurrency at a time (or all at once),
+// and merges their metrics, with expexp_federate_up reporting which of them
+// could be scraped, and expexp_federate_scrape_duration_seconds how long each
+// took.
+func (c federateConfig) gather(ctx context.Context) []*dto.MetricFamily {
+	results := make([][]*dto.MetricFamily, len(c.Upstreams))
+	ok := make([]bool, len(c.Upstreams))
+	durations := make([]float64, len(c.Upstreams))
+	var slots chan struct{}
+	if c.FanoutConcurrency > 0 {
+		slots = make(chan struct{}, c.FanoutConcurrency)
+	}
+	var wg sync.WaitGroup
+	for i, u := range c.Upstreams {
+		wg.Add(1)
+		go func(i int, u *federateUpstream) {
+			defer wg.Done()
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					log.Warnf("federate module %v timed out waiting to scrape upstream %v (fanout_concurrency)", c.mcfg.name, u.Name)
+					return
+				}
+			}
+			start := time.Now()
+			mfs, err := c.scrape(ctx, u)
+			durations[i] = time.Since(start).Seconds()
+			if err != nil {
+				log.Warnf("federate module %v failed scraping upstream %v, %v", c.mcfg.name, u.Name, err)
+				return
+			}
+			results[i], ok[i] = mfs, true
+		}(i, u)
+	}
+	wg.Wait()
+
+	merged := make(map[string]*dto.MetricFamily)
+	up := &dto.MetricFamily{
+		Name: stringPtr("expexp_federate_up"),
+		Help: stringPtr("Whether the upstream of the federate module could be scraped"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	duration := &dto.MetricFamily{
+		Name: stringPtr("expexp_federate_scrape_duration_seconds"),
+		Help: stringPtr("Time taken scraping the upstream of the federate module, 0 if it was never scraped"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for i, u := range c.Upstreams {
+		v := 0.0
+		if ok[i] {
+			v = 1
+		}
+		up.Metric = append(up.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: stringPtr("upstream"), Value: stringPtr(u.Name)}},
+			Gauge: &dto.Gauge{Value: &v},
+		})
+		duration.Metric = append(duration.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: stringPtr("upstream"), Value: stringPtr(u.Name)}},
+			Gauge: &dto.Gauge{Value: &durations[i]},
+		})
+
+		for _, mf := range results[i] {
+			for _, m := range mf.Metric {
+				c.label(m, u)
+			}
+			existing, found := merged[mf.GetName()]
+			if !found {
+				merged[mf.GetName()] = mf
+				continue
+			}
+			if existing.GetType() != mf.GetType() {
+				log.Warnf("federate module %v dropped %v from upstream %v, its type differs from that of another upstream", c.mcfg.name, mf.GetName(), u.Name)
+				continue
+			}
+			existing.Metric = append(existing.Metric, mf.Metric...)
+		}
+	}
+
+	var result []*dto.MetricFamily
+	for _, mf := range merged {
+		result = append(result, mf)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	if c.mcfg.rewrites() {
+		result = c.mcfg.rewriteMetricFamilies(result)
+	}
+	return append(result, duration, up)
+}
+
+// label adds the upstream label, and the labels of the upstream, to m. As with
+// prometheus's honor_labels, a label m already has is either kept, or renamed
+// with an exported_ prefix.
+func (c federateConfig) label(m *dto.Metric, u *federateUpstream) {
+	labels := map[string]string{"upstream": u.Name}
+	for k, v := range u.Labels {
+		labels[k] = v
+	}
+	for _, l := range m.Label {
+		if _, ok := labels[l.GetName()]; !ok {
+			continue
+		}
+		if c.HonorLabels {
+			delete(labels, l.GetName())
+			continue
+		}
+		l.Name = stringPtr("exported_" + l.GetName())
+	}
+
+	var names []string
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		m.Label = append(m.Label, &dto.LabelPair{Name: stringPtr(k), Value: stringPtr(labels[k])})
+	}
+}
+
+func (c federateConfig) scrape(ctx context.Context, u *federateUpstream) ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtText))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	format := expfmt.ResponseFormat(resp.Header)
+	if format != expfmt.FmtProtoDelim {
+		format = expfmt.FmtText
+	}
+	body := io.Reader(resp.Body)
+	if isOpenMetrics(resp.Header) {
+		bs, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(openMetricsToText(bs))
+	}
+
+	var mfs []*dto.MetricFamily
+	dec := expfmt.NewDecoder(body, format)
+	for {
+		mf := &dto.MetricFamily{}
+		err := dec.Decode(mf)
+		if errors.Is(err, io.EOF) {
+			return mfs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		mfs = append(mfs, mf)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// describe lists the names of the upstreams.
+func (c federateConfig) describe() string {
+	var names []string
+	for _, u := range c.Upstreams {
+		names = append(names, u.Name)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileConfig configures a module that serves the metrics in files written by
+// other programs, as node_exporter's textfile collector does.
+type fileConfig struct {
+	Paths []string               `yaml:"paths"` // no default
+	XXX   map[string]interface{} `yaml:",inline"`
+
+	mcfg *moduleConfig
+}
+
+func checkFileConfig(c *fileConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown file module configuration fields: %v", c.XXX)
+	}
+	if len(c.Paths) == 0 {
+		return errors.New("file modules must have at least one path")
+	}
+	for _, p := range c.Paths {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("bad path %q, %w", p, err)
+		}
+	}
+	return nil
+}
+
+func (c fileConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mfs := c.gather()
+	g := func() ([]*dto.MetricFamily, error) { return mfs, nil }
+	promhttp.HandlerFor(prometheus.GathererFunc(g), promhttp.HandlerOpts{}).ServeHTTP(&cacheHeaderWriter{ResponseWriter: w, mcfg: c.mcfg}, r)
+}
+
+// files returns the files matching the paths, each only once.
+func (c fileConfig) files() []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, p := range c.Paths {
+		matches, _ := filepath.Glob(p)
+		for _, f := range matches {
+			if !seen[f] {
+				seen[f] = true
+				files = append(files, f)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// gather reads and merges the metrics of every file, with
+// expexp_file_mtime_seconds giving the modification time of each file read,
+// and expexp_file_scrape_error whether any could not be. Files that fail to
+// parse are left out entirely, as are metrics whose type differs from that
+// in another file, or that repeat a series of another file.
+func (c fileConfig) gather() []*dto.MetricFamily {
+	merged := make(map[string]*dto.MetricFamily)
+	series := make(map[string]bool)
+	mtime := &dto.MetricFamily{
+		Name: stringPtr("expexp_file_mtime_seconds"),
+		Help: stringPtr("Modification time of the files read by the file module"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	failed := 0.0
+
+	for _, f := range c.files() {
+		mfs, t, err := readMetricsFile(f)
+		if err != nil {
+			log.Warnf("file module %v failed reading %v, %v", c.mcfg.name, f, err)
+			failed = 1
+			continue
+		}
+		mtime.Metric = append(mtime.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: stringPtr("file"), Value: stringPtr(f)}},
+			Gauge: &dto.Gauge{Value: &t},
+		})
+
+		for _, mf := range mfs {
+			existing, found := merged[mf.GetName()]
+			if found && existing.GetType() != mf.GetType() {
+				log.Warnf("file module %v dropped %v from %v, its type differs from that in another file", c.mcfg.name, mf.GetName(), f)
+				failed = 1
+				continue
+			}
+			if !found {
+				existing = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				merged[mf.GetName()] = existing
+			}
+			for _, m := range mf.Metric {
+				key := seriesKey(mf.GetName(), m)
+				if series[key] {
+					log.Warnf("file module %v dropped a duplicate series of %v from %v", c.mcfg.name, mf.GetName(), f)
+					failed = 1
+					continue
+				}
+				series[key] = true
+				existing.Metric = append(existing.Metric, m)
+			}
+		}
+	}
+
+	var result []*dto.MetricFamily
+	for _, mf := range merged {
+		if len(mf.Metric) != 0 {
+			result = append(result, mf)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	if c.mcfg.rewrites() {
+		result = c.mcfg.rewriteMetricFamilies(result)
+	}
+
+	scrapeError := &dto.MetricFamily{
+		Name:   stringPtr("expexp_file_scrape_error"),
+		Help:   stringPtr("Whether any of the files of the file module could not be read, or had to be partly dropped"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: &failed}}},
+	}
+	if len(mtime.Metric) != 0 {
+		result = append(result, mtime)
+	}
+	return append(result, scrapeError)
+}
+
+// readMetricsFile parses the text format metrics in path, returning them with
+// the modification time of the file.
+func readMetricsFile(path string) ([]*dto.MetricFamily, float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	var mfs []*dto.MetricFamily
+	for _, mf := range families {
+		mfs = append(mfs, mf)
+	}
+	return mfs, float64(st.ModTime().UnixNano()) / 1e9, nil
+}
+
+// seriesKey identifies a series by its metric name and labels.
+func seriesKey(name string, m *dto.Metric) string {
+	labels := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// describe lists the paths of the module.
+func (c fileConfig) describe() string {
+	return strings.Join(c.Paths, ",")
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// filterConfig configures a command that the output of a module is piped
+// through before being served.
+type filterConfig struct {
+	Command string                 `yaml:"command"` // no default
+	Args    []string               `yaml:"args"`    // no args
+	XXX     map[string]interface{} `yaml:",inline"`
+}
+
+func checkFilterConfig(c *filterConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown filter_command configuration fields: %v", c.XXX)
+	}
+	if c.Command == "" {
+		return errors.New("filter_command must have a command")
+	}
+	if *disableExec {
+		return errors.New("filter_command can't be used with -disable.exec")
+	}
+	return nil
+}
+
+// filter runs the command with in as its standard input, returning its
+// standard output. The command is killed if ctx is done first, and it failing
+// or exiting with a non-zero status is an error.
+func (c filterConfig) filter(ctx context.Context, module string, in []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	cmd.Env = append(os.Environ(), "EXPEXP_MODULE="+module)
+	cmd.Stdin = bytes.NewReader(in)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if execSlots != nil {
+		select {
+		case execSlots <- struct{}{}:
+			defer func() { <-execSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	selfMetrics.cmdStartsCount.WithLabelValues(module).Inc()
+	if err := cmd.Run(); err != nil {
+		selfMetrics.cmdFailsCount.WithLabelValues(module).Inc()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("filter command failed, %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// filterResponse pipes a buffered backend response through the filter
+// command.
+func (c filterConfig) filterResponse(res *http.Response, module string) error {
+	in, _ := ioutil.ReadAll(res.Body)
+	out, err := c.filter(res.Request.Context(), module, in)
+	if err != nil {
+		return err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(out))
+	res.ContentLength = int64(len(out))
+	res.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
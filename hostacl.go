@@ -0,0 +1,90 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hostACL holds the addresses of a set of hostnames. If resolving a host
+// fails, its last resolved addresses are kept.
+type hostACL struct {
+	hosts []string
+
+	mutex sync.RWMutex
+	addrs map[string][]net.IP
+}
+
+func newHostACL(hosts []string) *hostACL {
+	return &hostACL{
+		hosts: hosts,
+		addrs: make(map[string][]net.IP),
+	}
+}
+
+// resolve looks up the addresses of all of the hosts.
+func (h *hostACL) resolve(ctx context.Context) {
+	for _, host := range h.hosts {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			log.Warnf("failed resolving allowed host %v, keeping previous addresses, %v", host, err)
+			continue
+		}
+		log.Debugf("allowed host %v resolved to %v", host, ips)
+		h.mutex.Lock()
+		h.addrs[host] = ips
+		h.mutex.Unlock()
+	}
+}
+
+// refresh re-resolves the hosts every interval until ctx is done.
+func (h *hostACL) refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.resolve(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// contains reports whether addr is one of the addresses of the hosts.
+func (h *hostACL) contains(addr net.IP) bool {
+	if h == nil {
+		return false
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, ips := range h.addrs {
+		for _, ip := range ips {
+			if ip.Equal(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// empty reports whether there are no hosts configured.
+func (h *hostACL) empty() bool {
+	return h == nil || len(h.hosts) == 0
+}
@@ -14,15 +14,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -42,73 +50,476 @@ func (cfg moduleConfig) getReverseProxyDirectorFunc() (func(*http.Request), erro
 
 	cvs := base.Query()
 
+	acceptParams := make(map[string]url.Values)
+	for mt, p := range cfg.HTTP.AcceptParams {
+		vs, err := url.ParseQuery(p)
+		if err != nil {
+			return nil, fmt.Errorf("accept_params for %v should be a valid query string, %w", mt, err)
+		}
+		acceptParams[strings.ToLower(mt)] = vs
+	}
+
+	var forward map[string]bool
+	if len(cfg.HTTP.ForwardHeaders) > 0 {
+		forward = make(map[string]bool)
+		for _, h := range cfg.HTTP.ForwardHeaders {
+			forward[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
 	return func(r *http.Request) {
+		if cfg.rewrites() || cfg.HTTP.PaginateParam != "" || len(cfg.HTTP.ResponseReplacements) != 0 || cfg.FilterCommand != nil {
+			// Only the text and protobuf formats can be rewritten, and only
+			// the text format can be concatenated, have strings replaced, or
+			// be passed to a filter command.
+			r.Header.Set("Accept", string(expfmt.FmtText))
+		}
+
+		path, pathValues := base.Path, cvs
+		if cfg.HTTP.pathTemplate != nil {
+			// The parameters were checked before the request got here.
+			if u, err := cfg.HTTP.expandPath(r); err != nil {
+				log.Errorf("failed expanding the path template of module %v, %v", cfg.name, err)
+			} else {
+				path, pathValues = u.Path, u.Query()
+			}
+		}
+
+		// The first module parameter selected this module, any others are
+		// for the backend.
 		qvs := r.URL.Query()
-		for k, vs := range cvs {
+		for p := range cfg.HTTP.PathParams {
+			delete(qvs, p)
+		}
+		if mods := qvs["module"]; len(mods) > 1 && cfg.ExtraModuleParams == extraModuleParamsForward {
+			qvs["module"] = mods[1:]
+		} else {
+			delete(qvs, "module")
+		}
+		for k, vs := range pathValues {
 			for _, v := range vs {
 				qvs.Add(k, v)
 			}
 		}
-		qvs["module"] = qvs["module"][1:]
+		for k, vs := range acceptParamsFor(r.Header.Get("Accept"), acceptParams) {
+			qvs[k] = vs
+		}
+
+		if cfg.HTTP.PaginateParam != "" {
+			qvs.Set(cfg.HTTP.PaginateParam, "1")
+		}
 
 		r.URL.RawQuery = qvs.Encode()
 
+		// Hop-by-hop headers are always removed by the reverse proxy, but
+		// it can only find those named in Connection while it is kept.
+		if forward != nil {
+			hop := make(map[string]bool)
+			for _, v := range r.Header.Values("Connection") {
+				for _, h := range strings.Split(v, ",") {
+					hop[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+				}
+			}
+			for k := range r.Header {
+				if !forward[k] || hop[k] {
+					r.Header.Del(k)
+				}
+			}
+		}
+		for _, h := range cfg.HTTP.StripHeaders {
+			r.Header.Del(h)
+		}
+
+		if cfg.HTTP.AcceptGzip {
+			// Leaving Accept-Encoding unset lets the transport request a
+			// gzipped response and decompress it transparently.
+			r.Header.Del("Accept-Encoding")
+		}
+
 		for k, v := range cfg.HTTP.Headers {
 			r.Header.Add(k, v)
 		}
 
 		r.URL.Scheme = cfg.HTTP.Scheme
 		r.URL.Host = net.JoinHostPort(cfg.HTTP.Address, strconv.Itoa(cfg.HTTP.Port))
-		r.URL.Path = base.Path
-		if cfg.HTTP.BasicAuthUsername != "" && cfg.HTTP.BasicAuthPassword != "" {
-			r.SetBasicAuth(cfg.HTTP.BasicAuthUsername, cfg.HTTP.BasicAuthPassword)
+		r.URL.Path = path
+		if user, pass := cfg.HTTP.basicAuthUsername.Get(), cfg.HTTP.basicAuthPassword.Get(); user != "" && pass != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		if t := cfg.HTTP.bearerToken.Get(); t != "" {
+			r.Header.Set("Authorization", "Bearer "+t)
+		}
+		if cfg.HTTP.Login != nil {
+			for _, c := range cfg.HTTP.Login.current() {
+				r.AddCookie(c)
+			}
 		}
 	}, nil
 }
 
+// acceptParamsFor returns the query parameters configured for the first media
+// type in the accept header that has any.
+func acceptParamsFor(accept string, params map[string]url.Values) url.Values {
+	if len(params) == 0 {
+		return nil
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if vs, ok := params[mt]; ok {
+			return vs
+		}
+	}
+	return nil
+}
+
+// getReverseProxyModifyResponseFunc checks and rewrites backend responses.
+// Further pages of paginated backends are fetched with transport.
+func (cfg moduleConfig) getReverseProxyModifyResponseFunc(transport http.RoundTripper) func(*http.Response) error {
+	return func(res *http.Response) error {
+		if cfg.HTTP.Login != nil && sessionExpired(res) {
+			cfg.HTTP.Login.expire()
+			res.Body.Close()
+			return fmt.Errorf("session expired, backend responded with status %d, logging in again on the next scrape", res.StatusCode)
+		}
+
+		if res.StatusCode == http.StatusOK {
+			cfg.setCacheHeaders(res.Header)
+		}
+
+		if res.StatusCode == http.StatusOK && (cfg.FailOnEmpty || cfg.rewrites() || cfg.HTTP.PaginateParam != "" || len(cfg.HTTP.ResponseReplacements) != 0 || cfg.FilterCommand != nil) {
+			if cfg.HTTP.PaginateParam != "" {
+				if err := cfg.HTTP.paginate(res, transport); err != nil {
+					return err
+				}
+			} else if err := cfg.HTTP.bufferResponse(res); err != nil {
+				return err
+			}
+			if len(cfg.HTTP.ResponseReplacements) != 0 {
+				cfg.HTTP.replaceInResponse(res)
+			}
+			if cfg.FilterCommand != nil {
+				if err := cfg.FilterCommand.filterResponse(res, cfg.name); err != nil {
+					return err
+				}
+			}
+			if cfg.rewrites() {
+				if err := cfg.rewriteResponse(res); err != nil {
+					selfMetrics.proxyMalformedCount.WithLabelValues(cfg.name).Inc()
+					return fmt.Errorf("failed rewriting backend response, %w", err)
+				}
+			}
+			if cfg.FailOnEmpty && !hasSamples(res) {
+				selfMetrics.proxyMalformedCount.WithLabelValues(cfg.name).Inc()
+				return fmt.Errorf("backend response contains no samples")
+			}
+			return nil
+		}
+
+		if !cfg.HTTP.BufferResponse {
+			res.Body = &partialResponseReader{ReadCloser: res.Body, module: cfg.name}
+			return nil
+		}
+		return cfg.HTTP.bufferResponse(res)
+	}
+}
+
+// hasSamples reports whether a buffered response contains any samples. Text
+// format and OpenMetrics bodies are checked for a line that isn't a comment,
+// other formats for any content.
+func hasSamples(res *http.Response) bool {
+	if res.ContentLength == 0 {
+		return false
+	}
+	if expfmt.ResponseFormat(res.Header) == expfmt.FmtProtoDelim {
+		return true
+	}
+
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body = ioutil.NopCloser(bytes.NewReader(bs))
+	return containsSamples(bs)
+}
+
+// containsSamples reports whether text format or OpenMetrics metrics contain
+// a line that isn't a comment.
+func containsSamples(bs []byte) bool {
+	for _, line := range bytes.Split(bs, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 && line[0] != '#' {
+			return true
+		}
+	}
+	return false
+}
+
+// login makes sure there is a session with the backend, if it requires one.
+func (c httpConfig) login(ctx context.Context) error {
+	if c.Login == nil {
+		return nil
+	}
+	client := &http.Client{
+		Transport: c.Transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := &url.URL{
+		Scheme: c.Scheme,
+		Host:   net.JoinHostPort(c.Address, strconv.Itoa(c.Port)),
+	}
+	_, err := c.Login.session(ctx, client, base)
+	return err
+}
+
+// partialResponseReader records backend responses that fail part way through
+// the body, after the headers have been passed on to the scraper.
+type partialResponseReader struct {
+	io.ReadCloser
+	module string
+	failed bool
+}
+
+func (r *partialResponseReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !r.failed &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		r.failed = true
+		log.Warnf("module %v backend response failed part way through the body, %v", r.module, err)
+		selfMetrics.proxyPartialCount.WithLabelValues(r.module).Inc()
+	}
+	return n, err
+}
+
+// bufferResponse reads the whole of the backend response body before anything
+// is sent to the scraper, so that a backend failing part way through the body
+// results in an error, rather than a truncated scrape.
+func (c httpConfig) bufferResponse(res *http.Response) error {
+	body := io.Reader(res.Body)
+	if c.MaxResponseBytes > 0 {
+		body = io.LimitReader(res.Body, c.MaxResponseBytes+1)
+	}
+
+	bs, err := ioutil.ReadAll(body)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed reading backend response, %w", err)
+	}
+	if c.MaxResponseBytes > 0 && int64(len(bs)) > c.MaxResponseBytes {
+		return fmt.Errorf("backend response exceeds max_response_bytes of %d", c.MaxResponseBytes)
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(bs))
+	res.ContentLength = int64(len(bs))
+	res.Header.Set("Content-Length", strconv.Itoa(len(bs)))
+	return nil
+}
+
 func (cfg moduleConfig) getReverseProxyErrorHandlerFunc() func(http.ResponseWriter, *http.Request, error) {
 	return func(w http.ResponseWriter, _ *http.Request, err error) {
+		if errors.Is(err, errTargetNotAllowed) {
+			selfMetrics.proxyErrorCount.WithLabelValues(cfg.name).Inc()
+			http.Error(w, "backend not allowed by -backend.allowed-targets", http.StatusForbidden)
+			return
+		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			log.Errorf("Request time out for module '%s'", cfg.name)
+			if cfg.TimeoutResponse == timeoutResponseEmptyOK {
+				writeMetricFamilies(w, moduleUpFamily(cfg.name, 0))
+				return
+			}
+			if cfg.OnError != nil {
+				cfg.OnError.write(w)
+				return
+			}
 			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
 			return
 		}
 
 		log.Errorf("Proxy error for module '%s': %v", cfg.name, err)
+		if cfg.OnError != nil {
+			cfg.OnError.write(w)
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 	}
 }
 
-// BearerAuthMiddleware.
+// moduleUpFamily builds a single sample expexp_module_up metric family, used
+// to answer scrapes that could not be proxied with a synthetic result.
+func moduleUpFamily(module string, v float64) *dto.MetricFamily {
+	return syntheticGaugeFamily("expexp_module_up", "Whether the backend of the module could be scraped", module, v)
+}
+
+func syntheticGaugeFamily(name, help, module string, v float64) *dto.MetricFamily {
+	labelName := "module"
+	return &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: &labelName, Value: &module}},
+				Gauge: &dto.Gauge{Value: &v},
+			},
+		},
+	}
+}
+
+// writeMetricFamilies writes mfs to w in the text exposition format with a
+// 200 status.
+func writeMetricFamilies(w http.ResponseWriter, mfs ...*dto.MetricFamily) {
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	w.WriteHeader(http.StatusOK)
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			log.Errorf("Failed writing synthetic metrics, %v", err)
+			return
+		}
+	}
+}
+
+// BearerAuthMiddleware only allows requests carrying the token. If Header is
+// set, the token is read from it as is, otherwise it is taken from a Bearer
+// Authorization header.
 type BearerAuthMiddleware struct {
 	http.Handler
-	Token string
+	Token  *secret
+	Header string
 }
 
 func (b BearerAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+	var token string
+	if b.Header != "" {
+		token = r.Header.Get(b.Header)
+		if token == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(b.Header + " header is missing"))
+			return
+		}
+	} else {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("Authorization header is missing"))
+			return
+		}
+		ss := strings.SplitN(authHeader, " ", 2)
+		if !(len(ss) == 2 && ss[0] == "Bearer") {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("Authorization header not of Bearer type"))
+			return
+		}
+		token = ss[1]
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.Token.Get())) != 1 {
 		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("Authorization header is missing"))
+		_, _ = w.Write([]byte("Invalid Bearer Token"))
 		return
 	}
-	ss := strings.SplitN(authHeader, " ", 2)
-	if !(len(ss) == 2 && ss[0] == "Bearer") {
+	b.Handler.ServeHTTP(w, r)
+}
+
+// ClientCertMiddleware only allows TLS requests for Paths, and the paths below
+// them, from clients that presented a verified certificate. Requests that did
+// not arrive over TLS are not checked.
+type ClientCertMiddleware struct {
+	http.Handler
+	Paths []string
+}
+
+func (m ClientCertMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) == 0 && m.protected(r.URL.Path) {
 		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("Authorization header not of Bearer type"))
+		_, _ = w.Write([]byte("Client certificate required"))
 		return
 	}
-	if ss[1] != b.Token {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("Invalid Bearer Token"))
+	m.Handler.ServeHTTP(w, r)
+}
+
+func (m ClientCertMiddleware) protected(p string) bool {
+	return underPaths(p, m.Paths)
+}
+
+// underPaths reports whether p is one of paths, or below one of them.
+func underPaths(p string, paths []string) bool {
+	p = path.Clean("/" + p)
+	for _, pp := range paths {
+		pp = strings.TrimSuffix(path.Clean("/"+pp), "/")
+		if p == pp || strings.HasPrefix(p, pp+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPSRedirectMiddleware redirects requests to the same URL on the TLS
+// listener at Port, except for requests for Exempt paths, and the paths below
+// them, which are served.
+type HTTPSRedirectMiddleware struct {
+	http.Handler
+	Port           string
+	Exempt         []string
+	TrustedProxies []net.IPNet
+}
+
+func (m HTTPSRedirectMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if underPaths(r.URL.Path, m.Exempt) || m.forwardedHTTPS(r) {
+		m.Handler.ServeHTTP(w, r)
 		return
 	}
-	b.Handler.ServeHTTP(w, r)
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if m.Port != "443" {
+		host = net.JoinHostPort(host, m.Port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// forwardedHTTPS reports whether r came from a trusted proxy, with an
+// X-Forwarded-Proto header saying that the original request used HTTPS.
+func (m HTTPSRedirectMiddleware) forwardedHTTPS(r *http.Request) bool {
+	if len(m.TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return false
+	}
+	for _, network := range m.TrustedProxies {
+		if network.Contains(addr) {
+			proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+			return strings.EqualFold(strings.TrimSpace(proto), "https")
+		}
+	}
+	return false
 }
 
+// IPAddressAuthMiddleware only allows requests from clients in ACL or at the
+// addresses of Hosts, unless both are empty, and never allows requests from
+// clients in Deny.
 type IPAddressAuthMiddleware struct {
 	http.Handler
-	ACL []net.IPNet
+	ACL   []net.IPNet
+	Deny  []net.IPNet
+	Hosts *hostACL
 }
 
 func (m IPAddressAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -131,6 +542,26 @@ func (m IPAddressAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	for _, network := range m.Deny {
+		// client is in deny list
+		if network.Contains(addr) {
+			log.Infof("Access denied for %q", addr)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("Forbidden"))
+			return
+		}
+	}
+
+	if len(m.ACL) == 0 && m.Hosts.empty() {
+		m.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	if m.Hosts.contains(addr) {
+		m.Handler.ServeHTTP(w, r)
+		return
+	}
+
 	for _, network := range m.ACL {
 		// client is in access list
 		if network.Contains(addr) {
@@ -0,0 +1,223 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	discoveryTypeKubernetes = "kubernetes"
+
+	kubernetesPortAnnotation   = "expexp.io/port"
+	kubernetesPathAnnotation   = "expexp.io/path"
+	kubernetesSchemeAnnotation = "expexp.io/scheme"
+
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// kubernetesDiscoveryConfig configures the discovery of annotated pods from
+// the kubernetes API server.
+type kubernetesDiscoveryConfig struct {
+	APIServer       string                 `yaml:"api_server"`        // the in-cluster API server
+	BearerTokenFile string                 `yaml:"bearer_token_file"` // the service account token
+	CAFile          string                 `yaml:"ca_file"`           // the service account CA
+	Namespace       string                 `yaml:"namespace"`         // all namespaces
+	LabelSelector   string                 `yaml:"label_selector"`    // all pods
+	NodeName        string                 `yaml:"node_name"`         // all nodes
+	XXX             map[string]interface{} `yaml:",inline"`
+
+	client *http.Client
+}
+
+func checkKubernetesDiscoveryConfig(c *kubernetesDiscoveryConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown kubernetes discovery fields: %v", c.XXX)
+	}
+	if c.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errors.New("kubernetes discovery needs an api_server when not running in a cluster")
+		}
+		c.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if _, err := url.Parse(c.APIServer); err != nil {
+		return fmt.Errorf("bad api_server, %w", err)
+	}
+	if c.BearerTokenFile == "" {
+		c.BearerTokenFile = kubernetesServiceAccountDir + "/token"
+	}
+	if c.CAFile == "" {
+		c.CAFile = kubernetesServiceAccountDir + "/ca.crt"
+	}
+	// Lets the node name be given by the downward API, as ${NODE_NAME}.
+	c.NodeName = os.ExpandEnv(c.NodeName)
+
+	tlsConfig := &tls.Config{}
+	if bs, err := ioutil.ReadFile(c.CAFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return fmt.Errorf("no certificates found in %v", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed reading kubernetes CA, %w", err)
+	}
+	c.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return nil
+}
+
+type kubernetesPodList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []kubernetesPod `json:"items"`
+}
+
+type kubernetesPod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// pods lists the pods matching the namespace, label selector and node name.
+func (c *kubernetesDiscoveryConfig) pods(ctx context.Context) ([]kubernetesPod, error) {
+	p := "/api/v1/pods"
+	if c.Namespace != "" {
+		p = "/api/v1/namespaces/" + url.PathEscape(c.Namespace) + "/pods"
+	}
+	q := url.Values{"limit": {"500"}}
+	if c.LabelSelector != "" {
+		q.Set("labelSelector", c.LabelSelector)
+	}
+	if c.NodeName != "" {
+		q.Set("fieldSelector", "spec.nodeName="+c.NodeName)
+	}
+
+	var pods []kubernetesPod
+	for {
+		list, err := c.list(ctx, strings.TrimSuffix(c.APIServer, "/")+p+"?"+q.Encode())
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, list.Items...)
+		if list.Metadata.Continue == "" {
+			return pods, nil
+		}
+		q.Set("continue", list.Metadata.Continue)
+	}
+}
+
+func (c *kubernetesDiscoveryConfig) list(ctx context.Context, u string) (*kubernetesPodList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	// The token is read on every request, as projected tokens are rotated.
+	if bs, err := ioutil.ReadFile(c.BearerTokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(bs)))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed reading kubernetes token, %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pods failed with status %v", resp.Status)
+	}
+	list := &kubernetesPodList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("failed decoding pods, %w", err)
+	}
+	return list, nil
+}
+
+// podModule returns the module scraping an annotated, running pod, or nil if
+// the pod is not to be scraped.
+func podModule(pod kubernetesPod) (*moduleConfig, error) {
+	port, ok := pod.Metadata.Annotations[kubernetesPortAnnotation]
+	if !ok || pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+		return nil, nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return nil, fmt.Errorf("bad %v annotation %q", kubernetesPortAnnotation, port)
+	}
+
+	mc := &moduleConfig{
+		Method:     "http",
+		Timeout:    *defaultTimeout,
+		discovered: true,
+		HTTP: httpConfig{
+			Address: pod.Status.PodIP,
+			Port:    p,
+			Path:    pod.Metadata.Annotations[kubernetesPathAnnotation],
+			Scheme:  pod.Metadata.Annotations[kubernetesSchemeAnnotation],
+		},
+		labels: map[string]string{
+			"namespace": pod.Metadata.Namespace,
+			"pod":       pod.Metadata.Name,
+		},
+	}
+	return mc, nil
+}
+
+// runKubernetesDiscovery adds a module for every annotated pod, named
+// <namespace>_<pod>, and removes the modules of pods that are gone or no
+// longer annotated.
+func runKubernetesDiscovery(ctx context.Context, cfg *config) {
+	pods, err := cfg.Discovery.Kubernetes.pods(ctx)
+	if err != nil {
+		logrus.Errorf("kubernetes discovery failed, %v", err)
+		return
+	}
+
+	modules := make(map[string]*moduleConfig)
+	for _, pod := range pods {
+		name := pod.Metadata.Namespace + "_" + pod.Metadata.Name
+		mc, err := podModule(pod)
+		if err != nil {
+			logrus.Errorf("skipping pod %v, %v", name, err)
+			continue
+		}
+		if mc != nil {
+			modules[name] = mc
+		}
+	}
+	syncDiscoveredModules(cfg, modules, "pod")
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listen creates a listener for one of the web listen addresses.
+func listen(address string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: *keepAliveIntv}
+	if !*tcpKeepAlive {
+		lc.KeepAlive = -1
+	}
+	if *reusePort {
+		if reusePortSupported {
+			lc.Control = reusePortControl
+		} else {
+			log.Warnf("SO_REUSEPORT is not supported on this platform, listening on %s without it", address)
+		}
+	}
+	return lc.Listen(context.Background(), *listenNetwork, address)
+}
+
+// systemdListenFDsStart is the first file descriptor passed by systemd.
+const systemdListenFDsStart = 3
+
+// systemdListeners returns the listening sockets passed by systemd socket
+// activation, as the http and https listeners, as described by
+// namedListeners. The environment variables are cleared, so that exec modules
+// don't inherit them.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("-web.systemd-socket is set, but no sockets were passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("-web.systemd-socket is set, but no sockets were passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	files := make([]*os.File, n)
+	for i := range files {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(systemdListenFDsStart+i), name)
+	}
+	return namedListeners(files, names)
+}
+
+// namedListeners returns the listening sockets in files as the http and https
+// listeners. Sockets named http or https in names are used as such, and any
+// others fill the http and then the https listener in order. The files are
+// closed.
+func namedListeners(files []*os.File, names []string) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	var unnamed []net.Listener
+	for i, f := range files {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d is not a listening socket, %w", i, err)
+		}
+		if (name == "http" || name == "https") && listeners[name] == nil {
+			listeners[name] = l
+			continue
+		}
+		unnamed = append(unnamed, l)
+	}
+	for _, name := range []string{"http", "https"} {
+		if listeners[name] == nil && len(unnamed) != 0 {
+			listeners[name], unnamed = unnamed[0], unnamed[1:]
+		}
+	}
+	for _, l := range unnamed {
+		log.Warnf("ignoring extra systemd socket %v", l.Addr())
+		l.Close()
+	}
+	return listeners, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// discardResponseWriter is a ResponseWriter that only keeps the status.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(bs []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(bs), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// loadTest scrapes module through the proxy handler from concurrency
+// goroutines for duration, and writes a report of the results to out.
+func loadTest(out io.Writer, cfg *config, module string, concurrency int, duration time.Duration) error {
+	if cfg.getModule(module) == nil {
+		return fmt.Errorf("unknown module %v", module)
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("flag -load-test.concurrency must be at least 1")
+	}
+
+	var (
+		mutex     sync.Mutex
+		latencies []time.Duration
+		errors    int
+		wg        sync.WaitGroup
+	)
+	target := "/proxy?module=" + url.QueryEscape(module)
+	start := time.Now()
+	deadline := start.Add(duration)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				w := &discardResponseWriter{header: make(http.Header)}
+				st := time.Now()
+				cfg.doProxy(w, httptest.NewRequest("GET", target, nil))
+				took := time.Since(st)
+
+				mutex.Lock()
+				latencies = append(latencies, took)
+				if w.status != http.StatusOK && w.status != 0 {
+					errors++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if len(latencies) == 0 {
+		return fmt.Errorf("no scrapes of module %v completed", module)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+
+	fmt.Fprintf(out, "module:      %v\n", module)
+	fmt.Fprintf(out, "concurrency: %d\n", concurrency)
+	fmt.Fprintf(out, "duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "scrapes:     %d (%.1f/s)\n", len(latencies), float64(len(latencies))/elapsed.Seconds())
+	fmt.Fprintf(out, "errors:      %d (%.2f%%)\n", errors, 100*float64(errors)/float64(len(latencies)))
+	fmt.Fprintf(out, "latency:     p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	return nil
+}
@@ -22,37 +22,80 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
-	printVersion = flag.Bool("version", false, "Print the version and exit")
-
-	cfgFile  = flag.String("config.file", "expexp.yaml", "The path to the configuration file.")
-	cfgDirs  StringSliceFlag
-	skipDirs = flag.Bool("config.skip-dirs", false, "Skip non existent -config.dirs entries instead of terminating.")
-
-	addr = flag.String("web.listen-address", ":9999", "The address to listen on for HTTP requests.")
+	printVersion      = flag.Bool("version", false, "Print the version and exit")
+	durationHistogram = flag.Bool("metrics.duration-histogram", false, "Also export the proxy durations as the expexp_proxy_duration_seconds_histogram histogram, to allow migrating away from the expexp_proxy_duration_seconds summary.")
+	printMetrics      = flag.Bool("print-metrics", false, "Print the names and help of the metrics exposed about exporter_exporter itself and exit")
+
+	cfgFile       = flag.String("config.file", "expexp.yaml", "The path to the configuration file.")
+	cfgDirs       StringSliceFlag
+	checkBackends = flag.Duration("config.check-backends", 0, "Check that the backends of http modules accept connections within this timeout when loading the configuration, and those of new or changed modules on reload, failing if any non-optional backend does not. 0 disables the check.")
+	maxModules    = flag.Int("config.max-modules", 10000, "Maximum number of modules that can be configured or discovered, as a guard against runaway configuration generation. 0 is unlimited.")
+	modulesFile   = flag.String("config.modules-file", "", "The path to a file of module configurations, as YAML documents separated by ---, each naming its module in a name field.")
+	skipDirs      = flag.Bool("config.skip-dirs", false, "Skip non existent -config.dirs entries instead of terminating.")
+
+	discoveryOneshot      = flag.Bool("discovery.oneshot", false, "Run a single discovery cycle, write a file_sd file for all of the modules to -discovery.file-sd-output, and exit.")
+	discoveryFileSD       = flag.String("discovery.file-sd-output", "", "File to write the -discovery.oneshot file_sd targets to, stdout if empty.")
+	discoveryFileSDTarget = flag.String("discovery.file-sd-target", "", "Target address written by -discovery.oneshot, defaults to the hostname and the port of -web.listen-address. Also the target listed by /-/sd, which otherwise uses the host requested.")
+	discoveryMaxProbes    = flag.Int("discovery.max-concurrent-probes", 0, "Maximum number of discovery probes to run at once, across all discovery sources. 0 is unlimited.")
+	discoveryProbeRate    = flag.Float64("discovery.max-probes-per-second", 0, "Maximum rate at which discovery probes are started, across all discovery sources. 0 is unlimited.")
+
+	loadTestModule      = flag.String("load-test.module", "", "Scrape this module repeatedly through the proxy handler, print the latency percentiles, error rate and throughput, and exit. No listeners are started.")
+	loadTestConcurrency = flag.Int("load-test.concurrency", 1, "Number of concurrent scrapes made by -load-test.module.")
+	loadTestDuration    = flag.Duration("load-test.duration", 30*time.Second, "How long -load-test.module scrapes the module for.")
+
+	addr            = flag.String("web.listen-address", ":9999", "The address to listen on for HTTP requests.")
+	listenNetwork   = flag.String("web.listen-network", "tcp", "Network of the listeners: tcp, tcp4 or tcp6.")
+	execMaxProcs    = flag.Int("exec.max-processes", 0, "Maximum number of exec module commands running at once. 0 is twice the number of CPUs available, taking container CPU quotas into account, and a negative value is unlimited.")
+	shutdownDelay   = flag.Duration("web.shutdown-delay", 0, "On SIGTERM or SIGINT, keep serving for this long, with /-/ready reporting not ready, before shutting down gracefully.")
+	shutdownTimeout = flag.Duration("web.shutdown-timeout", 30*time.Second, "When shutting down, how long to wait for the requests in progress, including running exec commands, to complete before closing their connections. 0 waits for as long as they take.")
+	tcpKeepAlive    = flag.Bool("web.tcp-keepalive", true, "Enable TCP keep-alives on accepted connections.")
+	keepAliveIntv   = flag.Duration("web.tcp-keepalive-interval", 0, "Interval between TCP keep-alive probes on accepted connections. 0 uses the Go default (15s).")
+	systemdSocket   = flag.Bool("web.systemd-socket", false, "Use the sockets passed by systemd socket activation as the HTTP and HTTPS listeners, rather than -web.listen-address and -web.tls.listen-address. -web.reuse-port and the keepalive flags don't apply to these sockets.")
+	reusePort       = flag.Bool("web.reuse-port", false, "Set SO_REUSEPORT on the listening sockets, allowing several processes to listen on the same port (Linux, BSDs and macOS only).")
 
 	bearerToken     = flag.String("web.bearer.token", "", "Bearer authentication token.")
 	bearerTokenFile = flag.String("web.bearer.token-file", "", "File containing the Bearer authentication token.")
+	bearerHeader    = flag.String("web.bearer.header", "", "Read the bearer token, without a Bearer prefix, from this header instead of Authorization.")
+
+	secretsRefreshInterval = flag.Duration("secrets.refresh-interval", 5*time.Minute, "How often secrets taken from a secret provider (e.g. exec://) are re-resolved. 0 disables refreshing.")
+
+	acl  IPNetSliceFlag
+	deny IPNetSliceFlag
+
+	trustedProxies IPNetSliceFlag
+
+	allowHosts        StringSliceFlag
+	allowHostsRefresh = flag.Duration("allow.host.refresh-interval", time.Minute, "How often the hostnames given with -allow.host are re-resolved.")
+	allowHostsACL     *hostACL
 
-	acl IPNetSliceFlag
+	proxyBearerAuth     = flag.Bool("web.proxy.bearer-auth", true, "Require the bearer token, if configured, for the proxy and all other endpoints except the telemetry path.")
+	proxyACL            = flag.Bool("web.proxy.acl", true, "Apply -allow.net and -deny.net to the proxy and all other endpoints except the telemetry path.")
+	telemetryBearerAuth = flag.Bool("web.telemetry.bearer-auth", true, "Require the bearer token, if configured, for the telemetry path.")
+	telemetryACL        = flag.Bool("web.telemetry.acl", true, "Apply -allow.net and -deny.net to the telemetry path.")
 
 	certPath  = flag.String("web.tls.cert", "cert.pem", "Path to cert")
 	keyPath   = flag.String("web.tls.key", "key.pem", "Path to key")
@@ -60,60 +103,82 @@ var (
 	verify    = flag.Bool("web.tls.verify", false, "Enable client verification")
 	certMatch = flag.String("web.tls.certmatch", "", "if set, this is used as a regexp that is matched against any certificate subject, dnsname or email address, only certs with a match are verified. web.tls.verify must also be set")
 	tlsAddr   = flag.String("web.tls.listen-address", "", "The address to listen on for HTTPS requests.")
+	redirect  = flag.Bool("web.http-to-https-redirect", false, "Redirect requests to -web.listen-address to -web.tls.listen-address, except for /-/ready and ACME HTTP challenges.")
+
+	clientCertPaths StringSliceFlag
+	accessLogPaths  StringSliceFlag
+
+	adminAddr     = flag.String("web.admin.listen-address", "", "The address of an additional listener for the telemetry path. Disabled if empty.")
+	adminCertPath = flag.String("web.admin.tls.cert", "", "Path to the cert of the admin listener. If empty, the admin listener uses the TLS configuration of -web.tls.listen-address, if any.")
+	adminKeyPath  = flag.String("web.admin.tls.key", "", "Path to the key of the admin listener")
+	adminCAPath   = flag.String("web.admin.tls.ca", "", "Path to CA to auth admin listener clients against")
+	adminVerify   = flag.Bool("web.admin.tls.verify", false, "Enable client verification on the admin listener, as -web.tls.verify")
+	pprofListen   = flag.Bool("web.pprof-listen", false, "Serve /debug/pprof/ on a listener of its own at -web.pprof-listen-address, without authentication. Profiling is disabled otherwise.")
+	pprofAddr     = flag.String("web.pprof-listen-address", "127.0.0.1:6060", "The address of the profiling listener enabled by -web.pprof-listen.")
+
+	disableHTTP2 = flag.Bool("web.disable-http2", false, "Disable HTTP/2, serving only HTTP/1.1 on the TLS listener.")
+
+	tPath = flag.String("web.telemetry-path", "/metrics", "The path to serve exporter_exporter's own metrics on, empty to disable them.")
+	pPath = flag.String("web.proxy-path", "/proxy", "The path to serve proxied scrapes on, empty to disable proxying.")
+
+	defaultTimeout = flag.Duration("proxy.default-timeout", 30*time.Second, "Timeout of scrapes of modules that don't set their own timeout. 0 leaves them without a timeout.")
+	timeoutHeader  = flag.String("proxy.timeout-header", "", "Name of a request header carrying the scrape timeout (e.g. X-Prometheus-Scrape-Timeout-Seconds), as seconds or a duration. Used when shorter than the module timeout.")
+
+	moduleHeader  = flag.Bool("web.module-header", true, "Set an X-Expexp-Module header naming the module on proxied responses.")
+	backendHeader = flag.Bool("web.backend-header", false, "Set an X-Expexp-Backend header describing the module backend on proxied responses.")
 
-	tPath = flag.String("web.telemetry-path", "/metrics", "The address to listen on for HTTP requests.")
-	pPath = flag.String("web.proxy-path", "/proxy", "The address to listen on for HTTP requests.")
+	backendIdleConnTimeout     = flag.Duration("backend.idle-conn-timeout", 90*time.Second, "How long an idle connection to a backend is kept open before being closed. 0 keeps idle connections open indefinitely.")
+	backendMaxIdleConnsPerHost = flag.Int("backend.max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "Maximum number of idle connections kept open to each backend.")
+
+	unknownModuleResponse = flag.String("proxy.unknown-module-response", "not-found", "Response to requests for unknown modules, not-found (a 404) or empty-ok (a 200 with expexp_module_found 0).")
+	disableExec           = flag.Bool("disable.exec", false, "Refuse to load exec modules, modules with a filter_command, and exec:// secrets, so that no commands are ever run.")
+	unknownModuleStartup  = flag.Bool("proxy.unknown-module-startup-unavailable", false, "Respond to requests for unknown modules with a 503, rather than as -proxy.unknown-module-response, until the modules have been loaded, including those found by the first discovery run.")
+
+	testTimeout = flag.Duration("web.test-timeout", 10*time.Second, "Maximum duration of a module test scrape made via /-/test.")
+
+	healthyWindow = flag.Duration("modules.healthy-window", 5*time.Minute, "How recently a module must have been scraped successfully to be counted in expexp_modules_healthy.")
+
+	routePrefix = flag.String("web.route-prefix", "/", "Prefix for all HTTP endpoints, for use when served from a sub-path behind a reverse proxy.")
 
 	logLevel = LogLevelFlag(log.WarnLevel)
 	logJson  = flag.Bool("log.json", false, "Serialize log messages in JSON")
 
-	proxyDuration = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name: "expexp_proxy_duration_seconds",
-			Help: "Duration of proxying requests to configured exporters",
-		},
-		[]string{"module"},
-	)
-	proxyErrorCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_proxy_errors_total",
-			Help: "Counts of errors",
-		},
-		[]string{"module"},
-	)
-	proxyTimeoutCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_proxy_timeout_errors_total",
-			Help: "Counts of the number of times a proxy timeout occurred",
-		},
-		[]string{"module"},
-	)
-
-	proxyMalformedCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_malformed_content_errors_total",
-			Help: "Counts of unparsable scrape content errors",
-		},
-		[]string{"module"},
-	)
+	slowRequestThreshold = flag.Duration("log.slow-request-threshold", 0, "Log scrapes taking longer than this at the warning level. 0 disables logging slow scrapes.")
+	accessLogTLS         = flag.Bool("log.access.tls", false, "Include the TLS version and cipher suite of requests that arrived over TLS in the access log.")
+	accessLogSampleRate  = flag.Float64("log.access.sample-rate", 1.0, "Fraction of successful requests to write to the access log, between 0 and 1. Unsuccessful requests are always logged.")
 )
 
 func init() {
-	// register the collector metrics in the default
-	// registry.
-	prometheus.MustRegister(proxyDuration)
-	prometheus.MustRegister(proxyTimeoutCount)
-	prometheus.MustRegister(proxyErrorCount)
-	prometheus.MustRegister(proxyMalformedCount)
-	prometheus.MustRegister(cmdStartsCount)
-	prometheus.MustRegister(cmdFailsCount)
-
 	flag.Var(&cfgDirs, "config.dirs", "The path to directories of configuration files, can be specified multiple times.")
 	flag.Var(&acl, "allow.net", "Allow connection from this network specified in CIDR notation. Can be specified multiple times.")
+	flag.Var(&allowHosts, "allow.host", "Allow connection from the addresses this hostname resolves to. Can be specified multiple times.")
+	flag.Var(&trustedProxies, "web.trusted-proxy", "Trust the X-Forwarded-Proto header of requests from this network, specified in CIDR notation, when deciding whether to redirect to HTTPS. Can be specified multiple times.")
+	flag.Var(&allowedTargets, "backend.allowed-targets", "Only allow connections to backends matching this host:port, whose host may be a CIDR network and whose port may be left out or * to allow any. Can be specified multiple times. By default any backend is allowed.")
+	flag.Var(&deny, "deny.net", "Deny connection from this network specified in CIDR notation, even if allowed by -allow.net. Can be specified multiple times.")
 	flag.Var(&logLevel, "log.level", "Log level")
+	flag.Var(&accessLogPaths, "log.access.path", "Only write requests for this path and the paths below it to the access log. Can be specified multiple times. By default all paths are logged.")
+	flag.Var(&clientCertPaths, "web.tls.client-cert-path", "Only require a client certificate on the TLS listener for this path and the paths below it. Can be specified multiple times. By default all paths require one.")
 }
 
-func setup() (*config, error) {
+// loadModules reads the configuration file, -config.modules-file and the
+// module configs of -config.dirs, as at startup and on every reload. The
+// secrets the modules take from providers are resolved afresh, and kept with
+// the configuration.
+func loadModules() (*config, error) {
+	var cfg *config
+	secrets, err := collectSecrets(func() (err error) {
+		cfg, err = readModules()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg.secrets = secrets
+	return cfg, nil
+}
+
+// readModules reads and checks the modules for loadModules.
+func readModules() (*config, error) {
 	cfg := newConfig()
 	if *cfgFile != "" {
 		r, err := os.Open(*cfgFile)
@@ -126,11 +191,41 @@ func setup() (*config, error) {
 		if err != nil {
 			return nil, err
 		}
+		if *maxModules > 0 && len(cfg.Modules) > *maxModules {
+			return nil, fmt.Errorf("%s defines %d modules, more than the limit of %d (-config.max-modules)", *cfgFile, len(cfg.Modules), *maxModules)
+		}
 		for mn := range cfg.GetModules() {
 			log.Debugf("read module config '%s' from: %s", mn, *cfgFile)
 		}
 	}
 
+	if *modulesFile != "" {
+		r, err := os.Open(*modulesFile)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		mcfgs, err := readModuleConfigs(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading configs %s, %w", *modulesFile, err)
+		}
+		for _, mcfg := range mcfgs {
+			if m := cfg.getModule(mcfg.Name); m != nil {
+				return nil, fmt.Errorf("module %s is already defined", mcfg.Name)
+			}
+			if mcfg.Module.disabled {
+				log.Infof("module %s is disabled by its enabled_if condition", mcfg.Name)
+				continue
+			}
+
+			log.Debugf("read module config '%s' from: %s", mcfg.Name, *modulesFile)
+			if err := cfg.addModule(mcfg.Name, mcfg.Module); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	for _, cfgDir := range cfgDirs {
 		mfs, err := ioutil.ReadDir(cfgDir)
 		if err != nil {
@@ -167,10 +262,42 @@ func setup() (*config, error) {
 				return nil, fmt.Errorf("failed reading configs %s, %w", fullpath, err)
 			}
 
+			if mcfg.disabled {
+				log.Infof("module %s is disabled by its enabled_if condition", mn)
+				continue
+			}
+
 			log.Debugf("read module config '%s' from: %s", mn, fullpath)
-			cfg.addModule(mn, mcfg)
+			if err := cfg.addModule(mn, mcfg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cfg.buildAliases(); err != nil {
+		return nil, err
+	}
+	for _, m := range cfg.GetModules() {
+		if m.Timeout == 0 {
+			m.Timeout = *defaultTimeout
 		}
 	}
+	return cfg, nil
+}
+
+func setup() (*config, error) {
+	cfg, err := loadModules()
+	if err != nil {
+		return nil, err
+	}
+	if *checkBackends > 0 {
+		if _, err := cfg.checkBackends(*checkBackends, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range cfg.GetModules() {
+		initModuleMetrics(m)
+	}
+
 	if cfg.Discovery == nil {
 		cfg.Discovery =
 			&discoveryConfig{
@@ -183,7 +310,11 @@ func setup() (*config, error) {
 	}
 
 	if *bearerToken != "" {
-		cfg.bearerToken = *bearerToken
+		t, err := newSecret(*bearerToken)
+		if err != nil {
+			return nil, fmt.Errorf("web.bearer.token, %w", err)
+		}
+		cfg.bearerToken = t
 	}
 
 	if *bearerTokenFile != "" {
@@ -199,12 +330,39 @@ func setup() (*config, error) {
 		if len(t) == 0 {
 			return nil, errors.New("token file should not be empty")
 		}
-		cfg.bearerToken = t
+		cfg.bearerToken = staticSecret(t)
 	}
 
-	cfg.proxyPath = path.Clean("/" + *pPath)
-	cfg.telemetryPath = path.Clean("/" + *tPath)
-	if cfg.proxyPath == cfg.telemetryPath {
+	switch *listenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("flag -web.listen-network must be tcp, tcp4 or tcp6")
+	}
+	if *redirect && !*systemdSocket && (*addr == "" || *tlsAddr == "") {
+		return nil, fmt.Errorf("flag -web.http-to-https-redirect requires both -web.listen-address and -web.tls.listen-address")
+	}
+	if *keepAliveIntv < 0 {
+		return nil, fmt.Errorf("flag -web.tcp-keepalive-interval must not be negative")
+	}
+
+	if *accessLogSampleRate < 0 || *accessLogSampleRate > 1 {
+		return nil, fmt.Errorf("flag -log.access.sample-rate must be between 0 and 1")
+	}
+
+	switch *unknownModuleResponse {
+	case "not-found", "empty-ok":
+	default:
+		return nil, fmt.Errorf("flag -proxy.unknown-module-response must be not-found or empty-ok")
+	}
+
+	cfg.routePrefix = strings.TrimSuffix(path.Clean("/"+*routePrefix), "/")
+	if *pPath != "" {
+		cfg.proxyPath = path.Clean("/" + *pPath)
+	}
+	if *tPath != "" {
+		cfg.telemetryPath = path.Clean("/" + *tPath)
+	}
+	if cfg.proxyPath != "" && cfg.proxyPath == cfg.telemetryPath {
 		return nil, fmt.Errorf("flags -web.proxy-path and -web.telemetry-path can not be set to the same value")
 	}
 
@@ -214,44 +372,133 @@ func setup() (*config, error) {
 	if cfg.Discovery.Interval == "" {
 		cfg.Discovery.Interval = "5m"
 	}
+	if cfg.Discovery.ProbeConcurrency == 0 {
+		cfg.Discovery.ProbeConcurrency = 10
+	}
+	if cfg.Discovery.ProbeConcurrency < 0 || cfg.Discovery.ProbeTimeout < 0 {
+		return nil, fmt.Errorf("discovery probe_timeout and probe_concurrency must not be negative")
+	}
+	switch cfg.Discovery.Type {
+	case "":
+	case discoveryTypeKubernetes:
+		if cfg.Discovery.Kubernetes == nil {
+			cfg.Discovery.Kubernetes = &kubernetesDiscoveryConfig{}
+		}
+		if cfg.Discovery.Enabled {
+			if err := checkKubernetesDiscoveryConfig(cfg.Discovery.Kubernetes); err != nil {
+				return nil, err
+			}
+		}
+	case discoveryTypeDocker:
+		if cfg.Discovery.Docker == nil {
+			cfg.Discovery.Docker = &dockerDiscoveryConfig{}
+		}
+		if err := checkDockerDiscoveryConfig(cfg.Discovery.Docker); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown discovery type %q", cfg.Discovery.Type)
+	}
+	for name, exp := range cfg.Discovery.Exporters {
+		for l := range exp.Labels {
+			if err := checkLabelName(l); err != nil {
+				return nil, fmt.Errorf("bad labels for discovery exporter %v, %w", name, err)
+			}
+		}
+	}
 
 	dur, err := time.ParseDuration(cfg.Discovery.Interval)
 	cfg.Discovery.interval = dur
 	return cfg, err
 }
 
+// certMatches reports whether r matches the common name, or one of the DNS
+// names or email addresses, of cert.
+func certMatches(r *regexp.Regexp, cert *x509.Certificate) bool {
+	if r.MatchString(cert.Subject.CommonName) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if r.MatchString(name) {
+			return true
+		}
+	}
+	for _, name := range cert.EmailAddresses {
+		if r.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
 func getClientValidator(r *regexp.Regexp, helloInfo *tls.ClientHelloInfo) func([][]byte, [][]*x509.Certificate) error {
 	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			// Only possible when client certificates are optional, in
+			// which case ClientCertMiddleware checks for one.
+			return nil
+		}
 		for _, c := range verifiedChains {
-			leaf := c[0]
-
-			if r.MatchString(leaf.Subject.CommonName) {
+			if certMatches(r, c[0]) {
 				return nil
 			}
-
-			for _, name := range leaf.DNSNames {
-				if r.MatchString(name) {
-					return nil
-				}
-			}
-
-			for _, name := range leaf.EmailAddresses {
-				if r.MatchString(name) {
-					return nil
-				}
-			}
 		}
 		return errors.New("no client certificate subject or email address matched")
 	}
 }
 
-func setupTLS() (*tls.Config, error) {
-	var tlsConfig *tls.Config
-	if *tlsAddr == "" {
+func setupTLS(systemdTLS bool) (*tls.Config, error) {
+	if *tlsAddr == "" && !systemdTLS {
 		return nil, nil
 	}
+	tlsConfig, err := newTLSConfig(*certPath, *keyPath, *caPath, *verify, *certMatch, len(clientCertPaths) != 0)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, recordCertMetrics("https", tlsConfig)
+}
 
-	cert, err := tls.LoadX509KeyPair(*certPath, *keyPath)
+// setupAdminTLS returns the TLS configuration of the admin listener, which is
+// that of the main TLS listener, if any, unless an admin certificate is given.
+func setupAdminTLS(mainTLSConfig *tls.Config) (*tls.Config, error) {
+	if *adminAddr == "" {
+		return nil, nil
+	}
+	if *adminCertPath == "" {
+		return mainTLSConfig, nil
+	}
+	tlsConfig, err := newTLSConfig(*adminCertPath, *adminKeyPath, *adminCAPath, *adminVerify, "", false)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, recordCertMetrics("admin", tlsConfig)
+}
+
+// recordCertMetrics exports the validity period of the certificates of a
+// listener, replacing any previously recorded for it.
+func recordCertMetrics(listener string, tlsConfig *tls.Config) error {
+	selfMetrics.tlsCertNotAfter.DeletePartialMatch(prometheus.Labels{"listener": listener})
+	selfMetrics.tlsCertNotBefore.DeletePartialMatch(prometheus.Labels{"listener": listener})
+	for _, cert := range tlsConfig.Certificates {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("could not parse certificate, %w", err)
+		}
+		subject, serial := leaf.Subject.String(), leaf.SerialNumber.String()
+		selfMetrics.tlsCertNotAfter.WithLabelValues(listener, subject, serial).Set(float64(leaf.NotAfter.Unix()))
+		selfMetrics.tlsCertNotBefore.WithLabelValues(listener, subject, serial).Set(float64(leaf.NotBefore.Unix()))
+	}
+	return nil
+}
+
+// newTLSConfig builds a server TLS configuration. If optionalClientCert is set
+// client certificates are verified if given, but not required.
+func newTLSConfig(certPath, keyPath, caPath string, verify bool, certMatch string, optionalClientCert bool) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse key/cert, %w", err)
 	}
@@ -270,9 +517,9 @@ func setupTLS() (*tls.Config, error) {
 	}
 	tlsConfig.BuildNameToCertificate()
 
-	if !*verify {
+	if !verify {
 		pool := x509.NewCertPool()
-		cabs, err := ioutil.ReadFile(*caPath)
+		cabs, err := ioutil.ReadFile(caPath)
 		if err != nil {
 			return nil, fmt.Errorf("could not open ca file, %w", err)
 		}
@@ -281,10 +528,13 @@ func setupTLS() (*tls.Config, error) {
 			return nil, errors.New("failed loading ca certs")
 		}
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if optionalClientCert {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 		tlsConfig.ClientCAs = pool
 
-		if *certMatch != "" {
-			rx, err := regexp.Compile(*certMatch)
+		if certMatch != "" {
+			rx, err := regexp.Compile(certMatch)
 			if err != nil {
 				return nil, fmt.Errorf("tls.web.certmatch is not a valid regexp, %w", err)
 			}
@@ -294,8 +544,10 @@ func setupTLS() (*tls.Config, error) {
 				return serverConf, nil
 			}
 		}
-	} else if *certMatch != "" {
+	} else if certMatch != "" {
 		return nil, errors.New("tls.web.verify must be set to use certificate matching")
+	} else if optionalClientCert {
+		return nil, errors.New("tls.web.verify must be set to use web.tls.client-cert-path")
 	}
 
 	return tlsConfig, nil
@@ -305,14 +557,37 @@ func runListener(ctx context.Context, name string, lsnr net.Listener, handler ht
 	srvr := http.Server{
 		Handler: handler,
 	}
+	if *disableHTTP2 {
+		srvr.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	address := lsnr.Addr().String()
+	selfMetrics.listenerInfo.WithLabelValues(address, name).Set(1)
+	defer selfMetrics.listenerInfo.DeleteLabelValues(address, name)
+
+	shutdown := make(chan struct{})
 	go func() {
 		<-ctx.Done()
-		srvr.Shutdown(context.Background())
+		sctx := context.Background()
+		if *shutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			sctx, cancel = context.WithTimeout(sctx, *shutdownTimeout)
+			defer cancel()
+		}
+		if err := srvr.Shutdown(sctx); err != nil {
+			// Closing the connections cancels the requests, and so kills
+			// the commands of exec modules.
+			log.Warnf("listener %s still had requests in progress after %v (-web.shutdown-timeout), closing their connections", name, *shutdownTimeout)
+			srvr.Close()
+		}
+		close(shutdown)
 	}()
 
-	if err := srvr.Serve(lsnr); err != nil {
+	if err := srvr.Serve(lsnr); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("listener %s stopped, %w", name, err)
 	}
+	// Serve returns as soon as a shutdown starts, wait for the requests in
+	// progress to complete.
+	<-shutdown
 	return nil
 }
 
@@ -326,6 +601,7 @@ func main() {
 	}()
 
 	flag.Parse()
+	selfMetrics = newSelfMetrics(prometheus.DefaultRegisterer, *durationHistogram)
 	manageService()
 
 	if *printVersion {
@@ -333,68 +609,163 @@ func main() {
 		return
 	}
 
+	if *printMetrics {
+		err = selfMetrics.print(os.Stdout)
+		return
+	}
+
 	cfg, err := setup()
 	if err != nil {
 		return
 	}
-	tlsConfig, err := setupTLS()
+	selfMetrics.moduleHealth.setModules(cfg.GetModules, *healthyWindow)
+	selfMetrics.configLastReloadSuccessful.Set(1)
+	selfMetrics.configLastReloadSuccess.SetToCurrentTime()
+	setupExecLimit(*execMaxProcs)
+
+	if *loadTestModule != "" {
+		err = loadTest(os.Stdout, cfg, *loadTestModule, *loadTestConcurrency, *loadTestDuration)
+		return
+	}
+
+	if *discoveryOneshot {
+		target := *discoveryFileSDTarget
+		if target == "" {
+			target, err = fileSDTarget()
+			if err != nil {
+				return
+			}
+		}
+		err = discoverOnce(context.Background(), cfg, *discoveryFileSD, target)
+		return
+	}
+
+	var systemdLsnrs map[string]net.Listener
+	if *systemdSocket {
+		if systemdLsnrs, err = systemdListeners(); err != nil {
+			return
+		}
+	}
+
+	tlsConfig, err := setupTLS(systemdLsnrs["https"] != nil)
+	if err != nil {
+		return
+	}
+	adminTLSConfig, err := setupAdminTLS(tlsConfig)
 	if err != nil {
 		return
 	}
 
-	if *addr == "" && *tlsAddr == "" {
+	if *addr == "" && *tlsAddr == "" && *adminAddr == "" && !*systemdSocket {
 		log.Info("No web addresses to listen on, nothing to do!")
 		os.Exit(0)
 	}
 
-	var lsnr net.Listener
-	if *addr != "" {
-		lsnr, err = net.Listen("tcp", *addr)
-		if err != nil {
-			return
+	var lsnr, tlsLsnr net.Listener
+	if *systemdSocket {
+		lsnr, tlsLsnr = systemdLsnrs["http"], systemdLsnrs["https"]
+	} else {
+		if *addr != "" {
+			if lsnr, err = listen(*addr); err != nil {
+				return
+			}
+		}
+		if *tlsAddr != "" {
+			if tlsLsnr, err = listen(*tlsAddr); err != nil {
+				return
+			}
 		}
 	}
+	if tlsLsnr != nil {
+		tlsLsnr = tls.NewListener(tlsLsnr, tlsConfig)
+	}
 
-	var tlsLsnr net.Listener
-	if *tlsAddr != "" {
-		tlsLsnr, err = net.Listen("tcp", *tlsAddr)
+	var pprofLsnr net.Listener
+	if *pprofListen {
+		if host, _, err := net.SplitHostPort(*pprofAddr); err == nil {
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				log.Warnf("-web.pprof-listen-address %v is not a loopback address, profiling is served there without authentication", *pprofAddr)
+			}
+		}
+		pprofLsnr, err = listen(*pprofAddr)
 		if err != nil {
 			return
 		}
-
-		tlsLsnr = tls.NewListener(tlsLsnr, tlsConfig)
 	}
 
-	http.HandleFunc(cfg.proxyPath, cfg.doProxy)
-	http.HandleFunc("/", cfg.listModules)
-	http.Handle(cfg.telemetryPath, promhttp.Handler())
-
-	handler := http.Handler(http.DefaultServeMux)
-
-	if cfg.bearerToken != "" {
-		handler = &BearerAuthMiddleware{handler, cfg.bearerToken}
+	var adminLsnr net.Listener
+	if *adminAddr != "" {
+		adminLsnr, err = listen(*adminAddr)
+		if err != nil {
+			return
+		}
+		if adminTLSConfig != nil {
+			adminLsnr = tls.NewListener(adminLsnr, adminTLSConfig)
+		}
 	}
 
 	if len(acl) > 0 {
 		log.Infof("Allowing connections only from %v", acl)
-		handler = &IPAddressAuthMiddleware{handler, acl}
 	}
+	if len(deny) > 0 {
+		log.Infof("Denying connections from %v", deny)
+	}
+	if len(allowHosts) > 0 {
+		log.Infof("Allowing connections from hosts %v", allowHosts)
+		allowHostsACL = newHostACL(allowHosts)
+		allowHostsACL.resolve(context.Background())
+	}
+
+	handler := cfg.mainHandler()
 
 	log.SetLevel(log.Level(logLevel))
 	if *logJson {
 		log.SetFormatter(&log.JSONFormatter{})
 	}
-	handler = &AccessLogMiddleware{handler}
+	accessLogSampler := &accessLogSampler{rate: *accessLogSampleRate}
+	httpHandler := handler
+	if *redirect {
+		if lsnr == nil || tlsLsnr == nil {
+			err = errors.New("flag -web.http-to-https-redirect requires both an http and an https socket from systemd")
+			return
+		}
+		var tlsPort string
+		if _, tlsPort, err = net.SplitHostPort(tlsLsnr.Addr().String()); err != nil {
+			return
+		}
+		httpHandler = &HTTPSRedirectMiddleware{
+			Handler:        handler,
+			Port:           tlsPort,
+			Exempt:         []string{cfg.routePrefix + "/-/ready", "/.well-known/acme-challenge"},
+			TrustedProxies: trustedProxies,
+		}
+	}
+	httpHandler = &AccessLogMiddleware{httpHandler, accessLogSampler, accessLogPaths, *accessLogTLS}
+	handler = &AccessLogMiddleware{handler, accessLogSampler, accessLogPaths, *accessLogTLS}
+
+	logStartupConfig(cfg, tlsConfig)
 
-	eg, ctx := errgroup.WithContext(context.Background())
+	eg, ctx := errgroup.WithContext(shutdownContext(*shutdownDelay))
 
 	if cfg.Discovery.Enabled {
 		go startDiscovery(ctx, cfg)
+	} else {
+		atomic.StoreInt32(&cfg.loaded, 1)
+	}
+
+	go reloadOnSignal(ctx, cfg)
+
+	if *secretsRefreshInterval > 0 {
+		go refreshSecrets(ctx, cfg, *secretsRefreshInterval)
+	}
+
+	if allowHostsACL != nil && *allowHostsRefresh > 0 {
+		go allowHostsACL.refresh(ctx, *allowHostsRefresh)
 	}
 
 	if lsnr != nil {
 		eg.Go(func() error {
-			return runListener(ctx, "http", lsnr, handler)
+			return runListener(ctx, "http", lsnr, httpHandler)
 		})
 	}
 
@@ -404,9 +775,217 @@ func main() {
 		})
 	}
 
+	if adminLsnr != nil {
+		adminHandler := &AccessLogMiddleware{cfg.adminHandler(), accessLogSampler, accessLogPaths, *accessLogTLS}
+		eg.Go(func() error {
+			return runListener(ctx, "admin", adminLsnr, adminHandler)
+		})
+	}
+
+	if pprofLsnr != nil {
+		pprofHandler := &AccessLogMiddleware{pprofHandler(), accessLogSampler, accessLogPaths, *accessLogTLS}
+		eg.Go(func() error {
+			return runListener(ctx, "pprof", pprofLsnr, pprofHandler)
+		})
+	}
+
 	err = eg.Wait()
 }
 
+// pprofListenAddr returns the address of the profiling listener, or "" if
+// profiling is disabled.
+func pprofListenAddr() string {
+	if !*pprofListen {
+		return ""
+	}
+	return *pprofAddr
+}
+
+// pprofHandler serves /debug/pprof/ on the profiling listener. The handlers
+// are registered here rather than on http.DefaultServeMux, so that they are
+// never served anywhere else.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// fileSDTarget returns the address scrapers reach this instance at, from the
+// hostname and the port of the plain HTTP listener.
+func fileSDTarget() (string, error) {
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return "", fmt.Errorf("can't determine the port to write to file_sd from -web.listen-address, set -discovery.file-sd-target, %w", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// logStartupConfig logs a summary of the effective listener, authentication
+// and module configuration. No secrets are included.
+func logStartupConfig(cfg *config, tlsConfig *tls.Config) {
+	basicAuthModules, bearerAuthModules := 0, 0
+	modules := cfg.GetModules()
+	for _, m := range modules {
+		if m.Method == "http" && m.HTTP.BasicAuthUsername != "" {
+			basicAuthModules++
+		}
+		if m.Method == "http" && m.HTTP.bearerToken != nil {
+			bearerAuthModules++
+		}
+	}
+
+	fields := log.Fields{
+		"listen_address":        *addr,
+		"tls_listen_address":    *tlsAddr,
+		"systemd_socket":        *systemdSocket,
+		"admin_listen_address":  *adminAddr,
+		"pprof_listen_address":  pprofListenAddr(),
+		"tls_client_auth":       tlsConfig != nil && tlsConfig.ClientAuth != tls.NoClientCert,
+		"bearer_auth":           cfg.bearerToken != nil,
+		"bearer_auth_proxy":     cfg.bearerToken != nil && *proxyBearerAuth,
+		"bearer_auth_telemetry": cfg.bearerToken != nil && *telemetryBearerAuth,
+		"allow_nets":            len(acl),
+		"allow_hosts":           len(allowHosts),
+		"deny_nets":             len(deny),
+		"basic_auth_modules":    basicAuthModules,
+		"bearer_auth_modules":   bearerAuthModules,
+		"modules":               len(modules),
+		"discovery":             cfg.Discovery.Enabled,
+		"proxy_path":            cfg.proxyPath,
+		"telemetry_path":        cfg.telemetryPath,
+		"route_prefix":          cfg.routePrefix,
+	}
+	if cfg.Discovery.Enabled {
+		switch cfg.Discovery.Type {
+		case discoveryTypeKubernetes:
+			fields["discovery_type"] = cfg.Discovery.Type
+			fields["discovery_api_server"] = cfg.Discovery.Kubernetes.APIServer
+		case discoveryTypeDocker:
+			fields["discovery_type"] = cfg.Discovery.Type
+			fields["discovery_docker_host"] = cfg.Discovery.Docker.Host
+		default:
+			fields["discovery_target"] = cfg.Discovery.Address
+		}
+	}
+	log.WithFields(fields).Info("Starting exporter_exporter")
+}
+
+// disablePath makes the default path of the named path flag return a 404,
+// rather than the module listing, unless it is in use by another handler.
+func disablePath(mux *http.ServeMux, flagName, inUse string) {
+	p := flag.Lookup(flagName).DefValue
+	if p != inUse {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+}
+
+// protect wraps h in the configured bearer token and IP address
+// authentication.
+func (cfg *config) protect(h http.Handler, bearer, ipACL bool) http.Handler {
+	if bearer && cfg.bearerToken != nil {
+		h = &BearerAuthMiddleware{h, cfg.bearerToken, *bearerHeader}
+	}
+	if ipACL && (len(acl) > 0 || len(deny) > 0 || !allowHostsACL.empty()) {
+		h = &IPAddressAuthMiddleware{h, acl, deny, allowHostsACL}
+	}
+	return h
+}
+
+// instrument records the time h takes to serve requests in
+// expexp_http_request_duration_seconds, under the given handler name.
+func instrument(name string, h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(selfMetrics.httpRequestDuration.MustCurryWith(prometheus.Labels{"handler": name}), h)
+}
+
+// mainHandler serves the proxy, the module listing, the telemetry path and
+// the /-/ endpoints on the main listeners.
+func (cfg *config) mainHandler() http.Handler {
+	mux := http.NewServeMux()
+	if cfg.proxyPath != "" {
+		mux.Handle(cfg.proxyPath, cfg.protect(http.HandlerFunc(cfg.doProxy), *proxyBearerAuth, *proxyACL))
+	} else {
+		log.Infof("Proxying is disabled")
+		disablePath(mux, "web.proxy-path", cfg.telemetryPath)
+	}
+	mux.Handle("/", cfg.protect(instrument("listing", http.HandlerFunc(cfg.listModules)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/test", cfg.protect(instrument("test", http.HandlerFunc(cfg.testModule)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/errors", cfg.protect(instrument("errors", http.HandlerFunc(cfg.moduleErrors)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/sd", cfg.protect(instrument("sd", http.HandlerFunc(cfg.sdHandler)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/version", cfg.protect(instrument("version", http.HandlerFunc(versionHandler)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/reload", cfg.protect(instrument("reload", http.HandlerFunc(cfg.reloadHandler)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/ready", instrument("ready", http.HandlerFunc(ready)))
+	if cfg.telemetryPath != "" {
+		mux.Handle(cfg.telemetryPath, cfg.protect(instrument("metrics", promhttp.Handler()), *telemetryBearerAuth, *telemetryACL))
+	} else {
+		log.Infof("Telemetry is disabled")
+		disablePath(mux, "web.telemetry-path", cfg.proxyPath)
+	}
+
+	handler := http.Handler(mux)
+	if len(clientCertPaths) != 0 {
+		handler = &ClientCertMiddleware{handler, clientCertPaths}
+	}
+
+	if cfg.routePrefix != "" {
+		log.Infof("Serving all endpoints under %v", cfg.routePrefix)
+		handler = routePrefixHandler(cfg.routePrefix, handler)
+	}
+	return handler
+}
+
+// adminHandler serves the telemetry path, or its default if it is disabled on
+// the main listeners, and /-/version on the admin listener.
+func (cfg *config) adminHandler() http.Handler {
+	telemetryPath := cfg.telemetryPath
+	if telemetryPath == "" {
+		telemetryPath = flag.Lookup("web.telemetry-path").DefValue
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(telemetryPath, cfg.protect(instrument("metrics", promhttp.Handler()), *telemetryBearerAuth, *telemetryACL))
+	mux.Handle("/-/version", cfg.protect(instrument("version", http.HandlerFunc(versionHandler)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/reload", cfg.protect(instrument("reload", http.HandlerFunc(cfg.reloadHandler)), *proxyBearerAuth, *proxyACL))
+	mux.Handle("/-/ready", instrument("ready", http.HandlerFunc(ready)))
+
+	handler := http.Handler(mux)
+	if *adminCertPath == "" && len(clientCertPaths) != 0 {
+		// The listener shares the optional client verification of the main
+		// TLS listener, so the same paths need checking.
+		handler = &ClientCertMiddleware{handler, clientCertPaths}
+	}
+	if cfg.routePrefix != "" {
+		handler = routePrefixHandler(cfg.routePrefix, handler)
+	}
+	return handler
+}
+
+// routePrefixHandler strips prefix from incoming requests before passing them
+// to handler, requests outside of the prefix are rejected.
+func routePrefixHandler(prefix string, handler http.Handler) http.Handler {
+	stripped := http.StripPrefix(prefix, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusFound)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			// StripPrefix alone would also accept paths such as
+			// /prefixfoo, which are outside of the prefix.
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
 type responseWriterWithStatus struct {
 	http.ResponseWriter
 	status int
@@ -417,8 +996,31 @@ func (w *responseWriterWithStatus) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *responseWriterWithStatus) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 type AccessLogMiddleware struct {
 	http.Handler
+	Sampler *accessLogSampler
+	Paths   []string // all paths if empty
+	TLS     bool     // log the TLS version and cipher suite
+}
+
+// accessLogSampler selects an evenly spread fraction, rate, of the requests
+// it is asked about.
+type accessLogSampler struct {
+	rate  float64
+	count uint64
+}
+
+func (s *accessLogSampler) sample() bool {
+	if s == nil || s.rate >= 1 {
+		return true
+	}
+	n := atomic.AddUint64(&s.count, 1)
+	return uint64(float64(n)*s.rate) != uint64(float64(n-1)*s.rate)
 }
 
 func (middleware AccessLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -427,8 +1029,21 @@ func (middleware AccessLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.R
 		statusWriter = &responseWriterWithStatus{w, http.StatusOK}
 	)
 	defer func() {
+		if len(middleware.Paths) != 0 && !underPaths(r.URL.Path, middleware.Paths) {
+			return
+		}
+		if statusWriter.status < 300 && !middleware.Sampler.sample() {
+			return
+		}
 		remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
-		log.Infof(
+		entry := log.NewEntry(log.StandardLogger())
+		if middleware.TLS && r.TLS != nil {
+			entry = entry.WithFields(log.Fields{
+				"tls_version": tls.VersionName(r.TLS.Version),
+				"tls_cipher":  tls.CipherSuiteName(r.TLS.CipherSuite),
+			})
+		}
+		entry.Infof(
 			"%s - %s \"%s\" %d %s (took %s)",
 			remoteHost, r.Method, r.URL.RequestURI(), statusWriter.status,
 			http.StatusText(statusWriter.status), time.Since(start),
@@ -448,12 +1063,25 @@ func (cfg *config) doProxy(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("running module %v\n", mod[0])
 
 	if m := cfg.getModule(mod[0]); m != nil {
+		if m.name != mod[0] && m.WarnDeprecatedAlias {
+			log.Warnf("module %v requested via deprecated alias %v", m.name, mod[0])
+		}
 		m.ServeHTTP(w, r)
 		return
 	}
 
-	proxyErrorCount.WithLabelValues("unknown").Inc()
+	selfMetrics.proxyErrorCount.WithLabelValues("unknown").Inc()
+	if *unknownModuleStartup && atomic.LoadInt32(&cfg.loaded) == 0 {
+		log.Warnf("module %v requested before the modules have been loaded", mod)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("modules are still being loaded, module %v is not known yet\n", mod), http.StatusServiceUnavailable)
+		return
+	}
 	log.Warnf("unknown module requested  %v\n", mod)
+	if *unknownModuleResponse == "empty-ok" {
+		writeMetricFamilies(w, syntheticGaugeFamily("expexp_module_found", "Whether the requested module is configured", mod[0], 0))
+		return
+	}
 	http.Error(w, fmt.Sprintf("unknown module %v\n", mod), http.StatusNotFound)
 }
 
@@ -475,11 +1103,20 @@ func (cfg *config) listModules(w http.ResponseWriter, r *http.Request) {
 		tmpl := template.Must(template.New("modules").Parse(`
 			<h2>Exporters:</h2>
 				<ul>
-					{{range $name, $cfg := .GetModules}}
-						<li><a href="/proxy?module={{$name}}">{{$name}}</a></li>
+					{{range $name, $cfg := .Modules}}
+						<li>{{if $.ProxyPath}}<a href="{{$.ProxyPath}}?module={{$name}}">{{$name}}</a>{{else}}{{$name}}{{end}}</li>
 					{{end}}
 				</ul>`))
-		err := tmpl.Execute(w, cfg)
+		data := struct {
+			Modules   map[string]*moduleConfig
+			ProxyPath string
+		}{
+			Modules: cfg.GetModules(),
+		}
+		if cfg.proxyPath != "" {
+			data.ProxyPath = cfg.routePrefix + cfg.proxyPath
+		}
+		err := tmpl.Execute(w, data)
 		if err != nil {
 			log.Error(err)
 			http.Error(w, "Can't execute the template", http.StatusInternalServerError)
@@ -487,35 +1124,362 @@ func (cfg *config) listModules(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type moduleTestResult struct {
+	Module     string  `json:"module"`
+	StatusCode int     `json:"status_code"`
+	Duration   float64 `json:"duration_seconds"`
+	BodyBytes  int     `json:"body_bytes"`
+	ParseError string  `json:"parse_error,omitempty"`
+}
+
+// testModule performs a scrape of a module and reports on the result, rather
+// than returning the scraped metrics.
+func (cfg *config) testModule(w http.ResponseWriter, r *http.Request) {
+	mod, ok := r.URL.Query()["module"]
+	if !ok {
+		http.Error(w, "require parameter module is missing", http.StatusBadRequest)
+		return
+	}
+
+	m := cfg.getModule(mod[0])
+	if m == nil {
+		http.Error(w, fmt.Sprintf("unknown module %v\n", mod[0]), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *testTimeout)
+	defer cancel()
+
+	rec := httptest.NewRecorder()
+	st := time.Now()
+	m.serveScrape(rec, r.WithContext(ctx), false)
+
+	res := moduleTestResult{
+		Module:     m.name,
+		StatusCode: rec.Code,
+		Duration:   time.Since(st).Seconds(),
+		BodyBytes:  rec.Body.Len(),
+	}
+	if rec.Code == http.StatusOK {
+		dec := expfmt.NewDecoder(rec.Body, expfmt.ResponseFormat(rec.Header()))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				if err != io.EOF {
+					res.ParseError = err.Error()
+				}
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorf("Failed writing test result, %v", err)
+	}
+}
+
 func (m moduleConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.serveScrape(w, r, true)
+}
+
+// serveScrape scrapes the module for r. Unless record is set, as for test
+// scrapes, the scrape isn't counted or timed, kept in the recent scrapes or
+// the module health, mirrored, or served from or kept in the cache. Counters
+// kept by the backends themselves, such as command starts, still count it.
+func (m moduleConfig) serveScrape(w http.ResponseWriter, r *http.Request, record bool) {
+	countError := func() {
+		if record {
+			selfMetrics.proxyErrorCount.WithLabelValues(m.name).Inc()
+		}
+	}
+
 	st := time.Now()
 	defer func() {
-		proxyDuration.WithLabelValues(m.name).Observe(float64(time.Since(st)) / float64(time.Second))
+		if !record {
+			return
+		}
+		dur := time.Since(st)
+		d := float64(dur) / float64(time.Second)
+		selfMetrics.proxyDuration.WithLabelValues(m.name).Observe(d)
+		if *slowRequestThreshold > 0 && dur > *slowRequestThreshold {
+			log.Warnf("slow scrape of module %v took %v", m.name, dur)
+		}
+		if *durationHistogram {
+			selfMetrics.proxyDurationHistogram.WithLabelValues(m.name).Observe(d)
+		}
 	}()
 
+	timeout := m.Timeout
+	if d, ok := m.headerTimeout(r); ok && (timeout == 0 || d < timeout) {
+		timeout = d
+	}
+
 	nr := r
-	if m.Timeout != 0 {
-		log.Debugf("setting module %v timeout to %v", m.name, m.Timeout)
-		ctx, cancel := context.WithTimeout(r.Context(), m.Timeout)
+	if timeout != 0 {
+		log.Debugf("setting module %v timeout to %v", m.name, timeout)
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 		nr = r.WithContext(ctx)
 	}
 
+	if *moduleHeader {
+		w.Header().Set("X-Expexp-Module", m.name)
+	}
+	if *backendHeader {
+		w.Header().Set("X-Expexp-Backend", m.backend())
+	}
+
+	sw := &responseWriterWithStatus{w, http.StatusOK}
+	w = sw
+	defer func() {
+		if !record {
+			return
+		}
+		result := scrapeResult(nr.Context(), sw.status)
+		selfMetrics.proxyScrapeCount.WithLabelValues(m.name, result).Inc()
+		recentScrapes.add(m.name, scrapeRecord{
+			Time:     st,
+			Status:   sw.status,
+			Result:   result,
+			Duration: time.Since(st).Seconds(),
+		})
+		selfMetrics.moduleHealth.scraped(m.name, result == "success")
+		selfMetrics.moduleLastScrape.WithLabelValues(m.name).SetToCurrentTime()
+	}()
+
+	if !m.clientAllowed(r) {
+		log.Warnf("rejected request for module %v from a client whose certificate does not match allowed_client_certs", m.name)
+		countError()
+		http.Error(w, "client certificate not allowed for this module", http.StatusForbidden)
+		return
+	}
+
+	if m.Auth != nil {
+		if !m.Auth.allowed(r) {
+			log.Warnf("rejected request for module %v without its auth credentials", m.name)
+			countError()
+			m.Auth.challenge(w, m.name)
+			http.Error(w, "missing or invalid credentials for this module", http.StatusUnauthorized)
+			return
+		}
+		// The credentials are for exporter_exporter, not the backend.
+		r.Header.Del(m.Auth.header())
+	}
+
+	if p, ok := m.extraModuleParam(r); !ok {
+		log.Warnf("rejected request for module %v with another module parameter %q", m.name, p)
+		countError()
+		http.Error(w, fmt.Sprintf("ambiguous module parameters %v\n", r.URL.Query()["module"]), http.StatusBadRequest)
+		return
+	}
+
+	if p, ok := m.disallowedParam(r); !ok {
+		log.Warnf("rejected request for module %v with disallowed parameter %q", m.name, p)
+		countError()
+		http.Error(w, fmt.Sprintf("parameter %q is not allowed", p), http.StatusBadRequest)
+		return
+	}
+
+	if m.Method == "http" && m.HTTP.pathTemplate != nil {
+		if _, p, ok := m.HTTP.pathParamValues(r); !ok {
+			log.Warnf("rejected request for module %v with missing or disallowed path parameter %q", m.name, p)
+			countError()
+			http.Error(w, fmt.Sprintf("parameter %q is missing or not allowed", p), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if record && m.Mirror != nil {
+		m.Mirror.mirror(m.name, m.Timeout)
+	}
+
+	if record && m.Cache != nil && m.Cache.serveFresh(w, nr, m.name) {
+		return
+	}
+
+	if m.slots != nil {
+		if !m.acquire(nr.Context()) {
+			log.Warnf("module %v timed out waiting for one of %d concurrent scrapes to complete", m.name, m.MaxConcurrency)
+			if record {
+				selfMetrics.proxyTimeoutCount.WithLabelValues(m.name).Inc()
+			}
+			http.Error(w, "timed out waiting for concurrent scrapes", http.StatusGatewayTimeout)
+			return
+		}
+		defer func() { <-m.slots }()
+	}
+
+	if record && m.Cache != nil {
+		m.Cache.serve(w, nr, m.name, m.serveBackend)
+		return
+	}
+	m.serveBackend(w, nr)
+}
+
+// serveBackend scrapes the module's backend.
+func (m moduleConfig) serveBackend(w http.ResponseWriter, r *http.Request) {
 	switch m.Method {
 	case "exec":
 		m.Exec.mcfg = &m
-		m.Exec.ServeHTTP(w, nr)
+		m.Exec.ServeHTTP(w, r)
 	case "http":
 		m.HTTP.mcfg = &m
-		m.HTTP.ServeHTTP(w, nr)
+		if err := m.HTTP.login(r.Context()); err != nil {
+			m.HTTP.ErrorHandler(w, r, err)
+			return
+		}
+		m.HTTP.ServeHTTP(w, r)
+	case "federate":
+		m.Federate.mcfg = &m
+		m.Federate.ServeHTTP(w, r)
+	case "file":
+		m.File.mcfg = &m
+		m.File.ServeHTTP(w, r)
 	default:
 		log.Errorf("unknown module method  %v\n", m.Method)
-		proxyErrorCount.WithLabelValues(m.name).Inc()
+		selfMetrics.proxyErrorCount.WithLabelValues(m.name).Inc()
 		http.Error(w, fmt.Sprintf("unknown module method %v\n", m.Method), http.StatusNotFound)
 		return
 	}
 }
 
+// clientAllowed checks the verified client certificate of r against
+// AllowedClientCerts. Requests without one are only allowed if
+// AllowedClientCerts is empty.
+func (m moduleConfig) clientAllowed(r *http.Request) bool {
+	if len(m.allowedClientCerts) == 0 {
+		return true
+	}
+	if r.TLS == nil {
+		return false
+	}
+	for _, chain := range r.TLS.VerifiedChains {
+		for _, rx := range m.allowedClientCerts {
+			if certMatches(rx, chain[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// disallowedParam checks the query parameters of r against AllowedParams,
+// returning the first that is not allowed, and false, if there is one.
+// extraModuleParam returns a module parameter other than the first, and
+// false, if the request has one the module doesn't forward. Repeats of the
+// first are always accepted.
+func (m moduleConfig) extraModuleParam(r *http.Request) (string, bool) {
+	if m.ExtraModuleParams == extraModuleParamsForward {
+		return "", true
+	}
+	mods := r.URL.Query()["module"]
+	for _, other := range mods {
+		if other != mods[0] {
+			return other, false
+		}
+	}
+	return "", true
+}
+
+func (m moduleConfig) disallowedParam(r *http.Request) (string, bool) {
+	if m.AllowedParams == nil {
+		return "", true
+	}
+	for p := range r.URL.Query() {
+		if p == "module" {
+			continue
+		}
+		allowed := false
+		for _, ap := range m.AllowedParams {
+			if p == ap {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return p, false
+		}
+	}
+	return "", true
+}
+
+// acquire waits for a free concurrency slot, recording the time spent
+// waiting. It returns false if ctx is done first.
+func (m moduleConfig) acquire(ctx context.Context) bool {
+	st := time.Now()
+	defer func() {
+		selfMetrics.proxyWait.WithLabelValues(m.name).Observe(float64(time.Since(st)) / float64(time.Second))
+	}()
+
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// headerTimeout returns the timeout requested by the scraper in the configured
+// timeout header, if any.
+func (m moduleConfig) headerTimeout(r *http.Request) (time.Duration, bool) {
+	name := *timeoutHeader
+	if m.TimeoutHeader != "" {
+		name = m.TimeoutHeader
+	}
+	if name == "" {
+		return 0, false
+	}
+
+	v := r.Header.Get(name)
+	if v == "" {
+		log.Debugf("no %s header in request for module %v", name, m.name)
+		return 0, false
+	}
+
+	d, err := parseTimeout(v)
+	if err != nil {
+		log.Debugf("ignoring %s header for module %v, %v", name, m.name, err)
+		return 0, false
+	}
+	return d, true
+}
+
+// parseTimeout parses a timeout given either as a number of seconds or as a
+// duration string.
+func parseTimeout(v string) (time.Duration, error) {
+	var d time.Duration
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		d = time.Duration(secs * float64(time.Second))
+	} else if d, err = time.ParseDuration(v); err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", v)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q, must be positive", v)
+	}
+	return d, nil
+}
+
+// initModuleMetrics exports the initial values of the per module metrics for a
+// newly loaded module.
+func initModuleMetrics(m *moduleConfig) {
+	selfMetrics.moduleInfo.WithLabelValues(m.name, m.Method, m.backend()).Set(1)
+	selfMetrics.moduleLastScrape.WithLabelValues(m.name).Set(0)
+}
+
+// scrapeResult classifies the outcome of a proxied scrape for
+// expexp_proxy_scrapes_total.
+func scrapeResult(ctx context.Context, status int) string {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), status == http.StatusGatewayTimeout:
+		return "timeout"
+	case status >= 400:
+		return "error"
+	default:
+		return "success"
+	}
+}
+
 // StringSliceFlags collects multiple uses of a named flag into a slice.
 type StringSliceFlag []string
 
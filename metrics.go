@@ -0,0 +1,327 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// expexpMetrics are the metrics exporter_exporter exposes about itself.
+type expexpMetrics struct {
+	proxyDuration              *prometheus.SummaryVec
+	proxyDurationHistogram     *prometheus.HistogramVec
+	proxyWait                  *prometheus.HistogramVec
+	proxyErrorCount            *prometheus.CounterVec
+	proxyTimeoutCount          *prometheus.CounterVec
+	proxyPartialCount          *prometheus.CounterVec
+	proxyMalformedCount        *prometheus.CounterVec
+	moduleInfo                 *prometheus.GaugeVec
+	moduleLastScrape           *prometheus.GaugeVec
+	proxyScrapeCount           *prometheus.CounterVec
+	tlsCertNotAfter            *prometheus.GaugeVec
+	tlsCertNotBefore           *prometheus.GaugeVec
+	listenerInfo               *prometheus.GaugeVec
+	httpRequestDuration        *prometheus.HistogramVec
+	proxyStaleCount            *prometheus.CounterVec
+	proxyCacheHitCount         *prometheus.CounterVec
+	shadowScrapeCount          *prometheus.CounterVec
+	shadowParseErrorCount      *prometheus.CounterVec
+	shadowDroppedCount         *prometheus.CounterVec
+	cmdStartsCount             *prometheus.CounterVec
+	cmdFailsCount              *prometheus.CounterVec
+	cmdRetriesCount            *prometheus.CounterVec
+	configLastReloadSuccessful prometheus.Gauge
+	configLastReloadSuccess    prometheus.Gauge
+	backendConnsOpen           *prometheus.GaugeVec
+	discoveryProbesInFlight    prometheus.Gauge
+	buildInfo                  *prometheus.GaugeVec
+	moduleHealth               *moduleHealthCollector
+
+	// help holds the help text of every registered metric, by name, for
+	// -print-metrics.
+	help map[string]string
+}
+
+// selfMetrics are the metrics in use. Until main replaces them with metrics
+// registered with the default registry, they are registered with a registry
+// of their own, which nothing serves.
+var selfMetrics = newSelfMetrics(prometheus.NewRegistry(), false)
+
+// newSelfMetrics creates the metrics exporter_exporter exposes about itself,
+// and registers them with reg, so that a process embedding the proxy can keep
+// them apart from its own. The proxy duration histogram is only registered if
+// durationHistogram is set.
+func newSelfMetrics(reg prometheus.Registerer, durationHistogram bool) *expexpMetrics {
+	help := make(map[string]string)
+	counterOpts := func(name, h string) prometheus.CounterOpts {
+		help[name] = h
+		return prometheus.CounterOpts{Name: name, Help: h}
+	}
+	gaugeOpts := func(name, h string) prometheus.GaugeOpts {
+		help[name] = h
+		return prometheus.GaugeOpts{Name: name, Help: h}
+	}
+	summaryOpts := func(name, h string) prometheus.SummaryOpts {
+		help[name] = h
+		return prometheus.SummaryOpts{Name: name, Help: h}
+	}
+	histogramOpts := func(name, h string, buckets []float64) prometheus.HistogramOpts {
+		help[name] = h
+		return prometheus.HistogramOpts{Name: name, Help: h, Buckets: buckets}
+	}
+	describe := func(name, h string) *prometheus.Desc {
+		help[name] = h
+		return prometheus.NewDesc(name, h, nil, nil)
+	}
+	durationHistogramOpts := prometheus.HistogramOpts{
+		Name: "expexp_proxy_duration_seconds_histogram",
+		Help: "Duration of proxying requests to configured exporters, as a histogram",
+	}
+
+	m := &expexpMetrics{
+		proxyDuration: prometheus.NewSummaryVec(
+			summaryOpts("expexp_proxy_duration_seconds", "Duration of proxying requests to configured exporters"),
+			[]string{"module"},
+		),
+		proxyDurationHistogram: prometheus.NewHistogramVec(
+			durationHistogramOpts,
+			[]string{"module"},
+		),
+		proxyWait: prometheus.NewHistogramVec(
+			histogramOpts("expexp_proxy_wait_seconds", "Time spent waiting for a free slot before scraping modules with max_concurrency set", []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}),
+			[]string{"module"},
+		),
+		proxyErrorCount: prometheus.NewCounterVec(
+			counterOpts("expexp_proxy_errors_total", "Counts of errors"),
+			[]string{"module"},
+		),
+		proxyTimeoutCount: prometheus.NewCounterVec(
+			counterOpts("expexp_proxy_timeout_errors_total", "Counts of the number of times a proxy timeout occurred"),
+			[]string{"module"},
+		),
+		proxyPartialCount: prometheus.NewCounterVec(
+			counterOpts("expexp_proxy_partial_response_total", "Counts of responses that failed after part of the body was sent to the scraper"),
+			[]string{"module"},
+		),
+		proxyMalformedCount: prometheus.NewCounterVec(
+			counterOpts("expexp_malformed_content_errors_total", "Counts of unparsable scrape content errors"),
+			[]string{"module"},
+		),
+		moduleInfo: prometheus.NewGaugeVec(
+			gaugeOpts("expexp_module_info", "Configured modules, with their method and backend, always 1"),
+			[]string{"module", "method", "backend"},
+		),
+		moduleLastScrape: prometheus.NewGaugeVec(
+			gaugeOpts("expexp_module_last_scrape_timestamp_seconds", "Time of the last scrape of the module, 0 if it has not been scraped since being loaded"),
+			[]string{"module"},
+		),
+		proxyScrapeCount: prometheus.NewCounterVec(
+			counterOpts("expexp_proxy_scrapes_total", "Counts of proxied scrapes by module and final result (success, error or timeout)"),
+			[]string{"module", "result"},
+		),
+		tlsCertNotAfter: prometheus.NewGaugeVec(
+			gaugeOpts("expexp_tls_cert_not_after_timestamp_seconds", "Expiry time of the server certificates of the TLS listeners"),
+			[]string{"listener", "subject", "serial"},
+		),
+		tlsCertNotBefore: prometheus.NewGaugeVec(
+			gaugeOpts("expexp_tls_cert_not_before_timestamp_seconds", "Start of the validity of the server certificates of the TLS listeners"),
+			[]string{"listener", "subject", "serial"},
+		),
+		listenerInfo: prometheus.NewGaugeVec(
+			gaugeOpts("expexp_listener_info", "Listeners accepting connections, by address and listener (http, https, admin or pprof), always 1"),
+			[]string{"address", "protocol"},
+		),
+		httpRequestDuration: prometheus.NewHistogramVec(
+			histogramOpts("expexp_http_request_duration_seconds", "Time taken to serve requests to endpoints other than the proxy, by handler", []float64{.005, .01, .05, .1, .5, 1, 5}),
+			[]string{"handler"},
+		),
+		proxyStaleCount: prometheus.NewCounterVec(
+			counterOpts("expexp_proxy_stale_responses_total", "Counts of cached responses served in place of failed scrapes"),
+			[]string{"module"},
+		),
+		proxyCacheHitCount: prometheus.NewCounterVec(
+			counterOpts("expexp_proxy_cache_hits_total", "Counts of scrapes answered from the cache, within the ttl of the module"),
+			[]string{"module"},
+		),
+		shadowScrapeCount: prometheus.NewCounterVec(
+			counterOpts("expexp_shadow_scrapes_total", "Counts of mirrored scrapes of shadow backends, by response status or error"),
+			[]string{"module", "shadow", "status"},
+		),
+		shadowDroppedCount: prometheus.NewCounterVec(
+			counterOpts("expexp_shadow_scrapes_dropped_total", "Counts of scrapes not mirrored because too many mirrored scrapes were running or queued"),
+			[]string{"module", "shadow"},
+		),
+		shadowParseErrorCount: prometheus.NewCounterVec(
+			counterOpts("expexp_shadow_parse_errors_total", "Counts of unparsable responses from shadow backends"),
+			[]string{"module", "shadow"},
+		),
+		cmdStartsCount: prometheus.NewCounterVec(
+			counterOpts("expexp_command_starts_total", "Counts of command starts"),
+			[]string{"module"},
+		),
+		cmdFailsCount: prometheus.NewCounterVec(
+			counterOpts("expexp_command_fails_total", "Count of commands with non-zero exits"),
+			[]string{"module"},
+		),
+		cmdRetriesCount: prometheus.NewCounterVec(
+			counterOpts("expexp_command_retries_total", "Count of commands re-run after failing"),
+			[]string{"module"},
+		),
+		configLastReloadSuccessful: prometheus.NewGauge(
+			gaugeOpts("expexp_config_last_reload_successful", "Whether the last configuration reload attempt was successful"),
+		),
+		configLastReloadSuccess: prometheus.NewGauge(
+			gaugeOpts("expexp_config_last_reload_success_timestamp_seconds", "Timestamp of the last successful configuration reload"),
+		),
+		backendConnsOpen: prometheus.NewGaugeVec(
+			gaugeOpts("expexp_backend_connections_open", "Number of connections to module backends currently open"),
+			[]string{"module"},
+		),
+		discoveryProbesInFlight: prometheus.NewGauge(
+			gaugeOpts("expexp_discovery_probes_in_flight", "Number of discovery probes currently running"),
+		),
+		buildInfo: prometheus.NewGaugeVec(
+			gaugeOpts("build_info", "A metric with a constant '1' value labeled by version, revision, branch and goversion from which exporter_exporter was built."),
+			[]string{"version", "revision", "branch", "goversion"},
+		),
+		moduleHealth: &moduleHealthCollector{
+			healthyDesc: describe("expexp_modules_healthy", "Number of modules whose last scrape succeeded within -modules.healthy-window"),
+			totalDesc:   describe("expexp_modules_total", "Number of configured modules"),
+			lastSuccess: make(map[string]time.Time),
+		},
+
+		help: help,
+	}
+	m.buildInfo.WithLabelValues(Version, Revision, Branch, GoVersion).Set(1)
+
+	reg.MustRegister(
+		m.proxyDuration,
+		m.proxyWait,
+		m.proxyErrorCount,
+		m.proxyTimeoutCount,
+		m.proxyPartialCount,
+		m.proxyMalformedCount,
+		m.moduleInfo,
+		m.moduleLastScrape,
+		m.proxyScrapeCount,
+		m.tlsCertNotAfter,
+		m.tlsCertNotBefore,
+		m.listenerInfo,
+		m.httpRequestDuration,
+		m.proxyStaleCount,
+		m.proxyCacheHitCount,
+		m.shadowScrapeCount,
+		m.shadowParseErrorCount,
+		m.shadowDroppedCount,
+		m.cmdStartsCount,
+		m.cmdFailsCount,
+		m.cmdRetriesCount,
+		m.configLastReloadSuccessful,
+		m.configLastReloadSuccess,
+		m.backendConnsOpen,
+		m.discoveryProbesInFlight,
+		m.buildInfo,
+		m.moduleHealth,
+	)
+	if durationHistogram {
+		help[durationHistogramOpts.Name] = durationHistogramOpts.Help
+		reg.MustRegister(m.proxyDurationHistogram)
+	}
+	return m
+}
+
+// print writes the name and help text of every registered metric to w,
+// sorted by name, for -print-metrics.
+func (m *expexpMetrics) print(w io.Writer) error {
+	names := make([]string, 0, len(m.help))
+	for n := range m.help {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", n, m.help[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduleHealthCollector counts the configured modules, and those that have
+// recently been scraped successfully, when it is collected.
+type moduleHealthCollector struct {
+	healthyDesc *prometheus.Desc
+	totalDesc   *prometheus.Desc
+
+	mutex       sync.Mutex
+	modules     func() map[string]*moduleConfig
+	window      time.Duration
+	lastSuccess map[string]time.Time
+}
+
+// setModules sets the source of the current modules, and the time since a
+// successful scrape within which a module is considered healthy.
+func (c *moduleHealthCollector) setModules(modules func() map[string]*moduleConfig, window time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.modules = modules
+	c.window = window
+}
+
+// scraped records the result of a scrape of a module.
+func (c *moduleHealthCollector) scraped(name string, success bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if success {
+		c.lastSuccess[name] = time.Now()
+	} else {
+		delete(c.lastSuccess, name)
+	}
+}
+
+// removed forgets a module that is no longer configured.
+func (c *moduleHealthCollector) removed(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.lastSuccess, name)
+}
+
+func (c *moduleHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.healthyDesc
+	ch <- c.totalDesc
+}
+
+func (c *moduleHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.modules == nil {
+		return
+	}
+
+	modules := c.modules()
+	healthy := 0
+	for name := range modules {
+		if t, ok := c.lastSuccess[name]; ok && time.Since(t) <= c.window {
+			healthy++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.healthyDesc, prometheus.GaugeValue, float64(healthy))
+	ch <- prometheus.MustNewConstMetric(c.totalDesc, prometheus.GaugeValue, float64(len(modules)))
+}
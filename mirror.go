@@ -0,0 +1,166 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrorConfig mirrors the scrapes of a module to a shadow backend, whose
+// responses are only recorded in metrics.
+type mirrorConfig struct {
+	URL                   string                 `yaml:"url"`                      // no default
+	Timeout               time.Duration          `yaml:"timeout"`                  // the module timeout
+	TLSInsecureSkipVerify bool                   `yaml:"tls_insecure_skip_verify"` // false
+	MaxConcurrency        int                    `yaml:"max_concurrency"`          // 1
+	MaxQueued             int                    `yaml:"max_queued"`               // 10
+	XXX                   map[string]interface{} `yaml:",inline"`
+
+	shadow string
+	client *http.Client
+	// pending holds a slot for every mirrored scrape running or queued, and
+	// running one for every scrape running.
+	pending chan struct{}
+	running chan struct{}
+}
+
+func checkMirrorConfig(c *mirrorConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown mirror configuration fields: %v", c.XXX)
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("bad url, %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url %q must be an absolute http or https url", c.URL)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.MaxConcurrency < 0 || c.MaxQueued < 0 {
+		return fmt.Errorf("max_concurrency and max_queued must not be negative")
+	}
+	if c.MaxConcurrency == 0 {
+		c.MaxConcurrency = 1
+	}
+	if c.MaxQueued == 0 {
+		c.MaxQueued = 10
+	}
+
+	c.shadow = u.Host
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}, // #nosec configurable
+			DialContext:     checkedDial((&net.Dialer{}).DialContext, net.DefaultResolver.LookupHost),
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	c.pending = make(chan struct{}, c.MaxConcurrency+c.MaxQueued)
+	c.running = make(chan struct{}, c.MaxConcurrency)
+	return nil
+}
+
+// mirror scrapes the shadow backend in the background, giving up after the
+// mirror's timeout, or timeout if it has none. At most MaxConcurrency scrapes
+// run at once, and up to MaxQueued more wait for their turn. Scrapes beyond
+// those, or that time out while queued, are dropped, so a slow shadow backend
+// can't pile them up.
+func (c *mirrorConfig) mirror(module string, timeout time.Duration) {
+	select {
+	case c.pending <- struct{}{}:
+	default:
+		selfMetrics.shadowDroppedCount.WithLabelValues(module, c.shadow).Inc()
+		return
+	}
+
+	if c.Timeout != 0 {
+		timeout = c.Timeout
+	}
+	go func() {
+		defer func() { <-c.pending }()
+
+		ctx := context.Background()
+		if timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		select {
+		case c.running <- struct{}{}:
+			defer func() { <-c.running }()
+		case <-ctx.Done():
+			selfMetrics.shadowDroppedCount.WithLabelValues(module, c.shadow).Inc()
+			return
+		}
+
+		status, err := c.scrape(ctx, module)
+		selfMetrics.shadowScrapeCount.WithLabelValues(module, c.shadow, status).Inc()
+		if err != nil {
+			log.Debugf("mirrored scrape of module %v to %v failed, %v", module, c.shadow, err)
+		}
+	}()
+}
+
+// scrape fetches and parses the shadow backend's metrics, returning the
+// status to record the scrape with.
+func (c *mirrorConfig) scrape(ctx context.Context, module string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return "error", err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtText))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "error", err
+	}
+	defer resp.Body.Close()
+
+	status := strconv.Itoa(resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		err := dec.Decode(new(dto.MetricFamily))
+		if errors.Is(err, io.EOF) {
+			return status, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return "error", err
+			}
+			selfMetrics.shadowParseErrorCount.WithLabelValues(module, c.shadow).Inc()
+			return status, err
+		}
+	}
+}
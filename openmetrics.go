@@ -0,0 +1,132 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// isOpenMetrics reports whether h declares an OpenMetrics text body.
+func isOpenMetrics(h http.Header) bool {
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mt == expfmt.OpenMetricsType
+}
+
+// openMetricsToText converts OpenMetrics text to the Prometheus text format,
+// which is all that can be parsed, for backends that send OpenMetrics although
+// the text format was asked for. Exemplars, UNIT lines and the # EOF marker
+// have no equivalent, and are dropped. Timestamps are converted from seconds
+// to milliseconds, counter families are named after their _total series, and
+// the types the text format lacks become gauges, or untyped for unknown and
+// gaugehistogram families.
+func openMetricsToText(bs []byte) []byte {
+	lines := strings.Split(string(bs), "\n")
+
+	counters := make(map[string]bool)
+	for _, line := range lines {
+		if f := strings.Fields(line); len(f) == 4 && f[0] == "#" && f[1] == "TYPE" && f[3] == "counter" && !strings.HasSuffix(f[2], "_total") {
+			counters[f[2]] = true
+		}
+	}
+
+	out := &bytes.Buffer{}
+	for _, line := range lines {
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			line = openMetricsComment(line, counters)
+		default:
+			line = openMetricsSample(line)
+		}
+		if line != "" {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes()
+}
+
+// openMetricsComment converts a comment line, returning "" if it is dropped.
+func openMetricsComment(line string, counters map[string]bool) string {
+	f := strings.SplitN(line, " ", 4)
+	if len(f) < 3 || f[0] != "#" {
+		return line
+	}
+	switch f[1] {
+	case "EOF", "UNIT":
+		return ""
+	case "HELP":
+		if counters[f[2]] {
+			f[2] += "_total"
+		}
+	case "TYPE":
+		if len(f) != 4 {
+			return line
+		}
+		if counters[f[2]] {
+			f[2] += "_total"
+		}
+		switch f[3] {
+		case "unknown", "gaugehistogram":
+			f[3] = "untyped"
+		case "info", "stateset":
+			f[3] = "gauge"
+		}
+	}
+	return strings.Join(f, " ")
+}
+
+// openMetricsSample converts a sample line, dropping its exemplar and giving
+// its timestamp in milliseconds.
+func openMetricsSample(line string) string {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return line
+	}
+	if line[end] == '{' {
+		// Label values may contain spaces, # and escaped quotes.
+		quoted := false
+		for end++; end < len(line); end++ {
+			c := line[end]
+			if quoted && c == '\\' {
+				end++
+			} else if c == '"' {
+				quoted = !quoted
+			} else if c == '}' && !quoted {
+				end++
+				break
+			}
+		}
+	}
+
+	series, rest := line[:end], line[end:]
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+	f := strings.Fields(rest)
+	if len(f) == 2 {
+		if ts, err := strconv.ParseFloat(f[1], 64); err == nil {
+			f[1] = strconv.FormatInt(int64(math.Round(ts*1000)), 10)
+		}
+	}
+	return series + " " + strings.Join(f, " ")
+}
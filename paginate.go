@@ -0,0 +1,95 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// paginate fetches the pages following res, the first page, with transport,
+// numbering them with PaginateParam, until one is empty or MaxPages have been
+// fetched. res is left with all of the pages concatenated, without repeated
+// HELP and TYPE lines. All of the pages are fetched within the context of the
+// first request, so within the module timeout.
+func (c httpConfig) paginate(res *http.Response, transport http.RoundTripper) error {
+	if err := c.bufferResponse(res); err != nil {
+		return err
+	}
+	page1, _ := ioutil.ReadAll(res.Body)
+	pages := [][]byte{page1}
+
+	for n := 2; n <= c.MaxPages && containsSamples(pages[len(pages)-1]); n++ {
+		req := res.Request.Clone(res.Request.Context())
+		qvs := req.URL.Query()
+		qvs.Set(c.PaginateParam, strconv.Itoa(n))
+		req.URL.RawQuery = qvs.Encode()
+
+		pres, err := transport.RoundTrip(req)
+		if err != nil {
+			return fmt.Errorf("failed fetching page %d, %w", n, err)
+		}
+		if pres.StatusCode != http.StatusOK {
+			pres.Body.Close()
+			return fmt.Errorf("failed fetching page %d, backend responded with status %d", n, pres.StatusCode)
+		}
+		if err := c.bufferResponse(pres); err != nil {
+			return fmt.Errorf("failed fetching page %d, %w", n, err)
+		}
+		page, _ := ioutil.ReadAll(pres.Body)
+		pages = append(pages, page)
+	}
+	log.Debugf("fetched %d pages from %v", len(pages), res.Request.URL.Host)
+
+	bs := concatPages(pages)
+	if c.MaxResponseBytes > 0 && int64(len(bs)) > c.MaxResponseBytes {
+		return fmt.Errorf("backend response exceeds max_response_bytes of %d", c.MaxResponseBytes)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(bs))
+	res.ContentLength = int64(len(bs))
+	res.Header.Set("Content-Length", strconv.Itoa(len(bs)))
+	return nil
+}
+
+// concatPages joins pages of text format metrics, keeping only the first
+// HELP and TYPE line for each metric.
+func concatPages(pages [][]byte) []byte {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		for _, line := range bytes.SplitAfter(page, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			if fields := bytes.Fields(line); len(fields) >= 3 && string(fields[0]) == "#" &&
+				(string(fields[1]) == "HELP" || string(fields[1]) == "TYPE") {
+				key := string(fields[1]) + " " + string(fields[2])
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			buf.Write(line)
+			if line[len(line)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	return buf.Bytes()
+}
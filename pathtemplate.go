@@ -0,0 +1,93 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// checkPathTemplate parses the path of an http module as a template if it has
+// path_params, checking that it only refers to those parameters.
+func (c *httpConfig) checkPathTemplate() error {
+	if len(c.PathParams) == 0 {
+		if strings.Contains(c.Path, "{{") {
+			return errors.New("path looks like a template, but there are no path_params")
+		}
+		return nil
+	}
+
+	c.pathParamREs = make(map[string]*regexp.Regexp)
+	sample := make(map[string]string)
+	for p, pattern := range c.PathParams {
+		if p == "module" {
+			return errors.New("path_params can't include module")
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("bad path_params pattern for %v, %w", p, err)
+		}
+		c.pathParamREs[p] = re
+		sample[p] = "x"
+	}
+
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(c.Path)
+	if err != nil {
+		return fmt.Errorf("bad path template, %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, sample); err != nil {
+		return fmt.Errorf("bad path template, %w", err)
+	}
+	if _, err := url.Parse(buf.String()); err != nil {
+		return fmt.Errorf("path template doesn't expand to a valid URL path, %w", err)
+	}
+	c.pathTemplate = tmpl
+	return nil
+}
+
+// pathParamValues returns the query escaped values of the path parameters of r. If
+// a parameter is missing, given more than once, or doesn't match its pattern,
+// its name is returned, and false.
+func (c httpConfig) pathParamValues(r *http.Request) (map[string]string, string, bool) {
+	qvs := r.URL.Query()
+	values := make(map[string]string)
+	for p, re := range c.pathParamREs {
+		vs := qvs[p]
+		if len(vs) != 1 || !re.MatchString(vs[0]) {
+			return nil, p, false
+		}
+		values[p] = url.QueryEscape(vs[0])
+	}
+	return values, "", true
+}
+
+// expandPath expands the path template with the parameters of r.
+func (c httpConfig) expandPath(r *http.Request) (*url.URL, error) {
+	values, p, ok := c.pathParamValues(r)
+	if !ok {
+		return nil, fmt.Errorf("parameter %q is missing or not allowed", p)
+	}
+	var buf bytes.Buffer
+	if err := c.pathTemplate.Execute(&buf, values); err != nil {
+		return nil, err
+	}
+	return url.Parse(buf.String())
+}
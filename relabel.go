@@ -0,0 +1,210 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+)
+
+// relabelConfig is a rule applied to the series of a module, as prometheus's
+// metric_relabel_configs are. The metric name is the __name__ label.
+type relabelConfig struct {
+	SourceLabels []string               `yaml:"source_labels"` // no labels
+	Separator    string                 `yaml:"separator"`     // ;
+	Regex        string                 `yaml:"regex"`         // (.*)
+	TargetLabel  string                 `yaml:"target_label"`  // no default
+	Replacement  string                 `yaml:"replacement"`   // $1
+	Action       string                 `yaml:"action"`        // replace
+	XXX          map[string]interface{} `yaml:",inline"`
+
+	regex *regexp.Regexp
+}
+
+func checkRelabelConfig(c *relabelConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown metric_relabel_configs fields: %v", c.XXX)
+	}
+	if c.Separator == "" {
+		c.Separator = ";"
+	}
+	if c.Regex == "" {
+		c.Regex = "(.*)"
+	}
+	if c.Replacement == "" {
+		c.Replacement = "$1"
+	}
+	if c.Action == "" {
+		c.Action = relabelReplace
+	}
+
+	var err error
+	if c.regex, err = regexp.Compile("^(?:" + c.Regex + ")$"); err != nil {
+		return fmt.Errorf("bad regex %q, %w", c.Regex, err)
+	}
+	for _, l := range c.SourceLabels {
+		if !labelNameRE.MatchString(l) {
+			return fmt.Errorf("%q is not a valid source label", l)
+		}
+	}
+
+	switch c.Action {
+	case relabelReplace:
+		if !labelNameRE.MatchString(c.TargetLabel) {
+			return fmt.Errorf("replace rules need a valid target_label, not %q", c.TargetLabel)
+		}
+	case relabelKeep, relabelDrop, relabelLabelMap:
+	case relabelLabelDrop, relabelLabelKeep:
+		if len(c.SourceLabels) != 0 || c.TargetLabel != "" {
+			return fmt.Errorf("%v rules match label names with regex, and can't have source_labels or a target_label", c.Action)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// relabel applies the rules to labels, in order, returning nil if the series
+// is to be dropped.
+func relabel(rules []*relabelConfig, labels map[string]string) map[string]string {
+	for _, c := range rules {
+		values := make([]string, 0, len(c.SourceLabels))
+		for _, l := range c.SourceLabels {
+			values = append(values, labels[l])
+		}
+		value := strings.Join(values, c.Separator)
+
+		switch c.Action {
+		case relabelKeep:
+			if !c.regex.MatchString(value) {
+				return nil
+			}
+		case relabelDrop:
+			if c.regex.MatchString(value) {
+				return nil
+			}
+		case relabelReplace:
+			idx := c.regex.FindStringSubmatchIndex(value)
+			if idx == nil {
+				continue
+			}
+			res := string(c.regex.ExpandString(nil, c.Replacement, value, idx))
+			if res == "" {
+				delete(labels, c.TargetLabel)
+				continue
+			}
+			labels[c.TargetLabel] = res
+		case relabelLabelMap:
+			mapped := make(map[string]string)
+			for n, v := range labels {
+				if c.regex.MatchString(n) {
+					mapped[c.regex.ReplaceAllString(n, c.Replacement)] = v
+				}
+			}
+			for n, v := range mapped {
+				labels[n] = v
+			}
+		case relabelLabelDrop:
+			for n := range labels {
+				if n != "__name__" && c.regex.MatchString(n) {
+					delete(labels, n)
+				}
+			}
+		case relabelLabelKeep:
+			for n := range labels {
+				if n != "__name__" && !c.regex.MatchString(n) {
+					delete(labels, n)
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// relabelMetricFamilies applies the module's metric_relabel_configs to the
+// series of mfs. Series whose name is changed are moved to the family of
+// that name, which is created with the type and help of the one they came
+// from if there is none. Families left without series are removed.
+func (cfg moduleConfig) relabelMetricFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily)
+	var result []*dto.MetricFamily
+	family := func(name string, like *dto.MetricFamily) *dto.MetricFamily {
+		if mf, ok := byName[name]; ok {
+			return mf
+		}
+		mf := &dto.MetricFamily{Name: stringPtr(name), Help: like.Help, Type: like.Type}
+		byName[name] = mf
+		result = append(result, mf)
+		return mf
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			labels := map[string]string{"__name__": mf.GetName()}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			labels = relabel(cfg.MetricRelabelConfigs, labels)
+			if labels == nil {
+				continue
+			}
+
+			name := labels["__name__"]
+			if !metricPrefixRE.MatchString(name) {
+				log.Warnf("module %v dropped a series of %v relabelled to the invalid name %q", cfg.name, mf.GetName(), name)
+				continue
+			}
+			to := family(name, mf)
+			if to.GetType() != mf.GetType() {
+				log.Warnf("module %v dropped a series of %v relabelled to %v, which has a different type", cfg.name, mf.GetName(), name)
+				continue
+			}
+
+			m.Label = m.Label[:0]
+			var names []string
+			for n, v := range labels {
+				if !strings.HasPrefix(n, "__") && v != "" && labelNameRE.MatchString(n) {
+					names = append(names, n)
+				}
+			}
+			sort.Strings(names)
+			for _, n := range names {
+				m.Label = append(m.Label, &dto.LabelPair{Name: stringPtr(n), Value: stringPtr(labels[n])})
+			}
+			to.Metric = append(to.Metric, m)
+		}
+	}
+
+	kept := result[:0]
+	for _, mf := range result {
+		if len(mf.Metric) != 0 {
+			kept = append(kept, mf)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadMutex serialises reloads, so that two of them can't interleave their
+// reads of the configuration files.
+var reloadMutex sync.Mutex
+
+// reload re-reads the module configuration, and swaps it in for the modules
+// of cfg. Requests already being proxied carry on with the module they
+// started with. Discovered modules that are not in the new configuration are
+// kept. Listener, TLS, authentication and discovery settings are not
+// reloaded. With -config.check-backends the backends of new and changed http
+// modules are checked before the swap, and their results returned.
+func (cfg *config) reload() ([]backendCheck, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	checks, err := cfg.reloadModules()
+	if err != nil {
+		selfMetrics.configLastReloadSuccessful.Set(0)
+		return checks, err
+	}
+	selfMetrics.configLastReloadSuccessful.Set(1)
+	selfMetrics.configLastReloadSuccess.SetToCurrentTime()
+	return checks, nil
+}
+
+func (cfg *config) reloadModules() ([]backendCheck, error) {
+	next, err := loadModules()
+	if err != nil {
+		return nil, err
+	}
+
+	old := cfg.GetModules()
+	for name, m := range old {
+		if !m.discovered || next.getModule(name) != nil {
+			continue
+		}
+		if err := next.addModule(name, m); err != nil {
+			log.Warnf("dropping discovered module %v, %v", name, err)
+		}
+	}
+	if err := next.buildAliases(); err != nil {
+		return nil, err
+	}
+	var checks []backendCheck
+	if *checkBackends > 0 {
+		if checks, err = next.checkBackends(*checkBackends, old); err != nil {
+			return checks, err
+		}
+	}
+
+	cfg.mutex.Lock()
+	cfg.Modules, cfg.aliases, cfg.secrets = next.Modules, next.aliases, next.secrets
+	cfg.mutex.Unlock()
+
+	for name, m := range old {
+		nm, ok := next.Modules[name]
+		if !ok {
+			selfMetrics.moduleInfo.DeleteLabelValues(name, m.Method, m.backend())
+			selfMetrics.moduleLastScrape.DeleteLabelValues(name)
+			selfMetrics.moduleHealth.removed(name)
+			continue
+		}
+		if nm.Method != m.Method || nm.backend() != m.backend() {
+			selfMetrics.moduleInfo.DeleteLabelValues(name, m.Method, m.backend())
+		}
+	}
+	for name, m := range next.Modules {
+		if _, ok := old[name]; !ok {
+			initModuleMetrics(m)
+			continue
+		}
+		selfMetrics.moduleInfo.WithLabelValues(name, m.Method, m.backend()).Set(1)
+	}
+
+	log.Infof("reloaded configuration, %d modules loaded", len(next.Modules))
+	return checks, nil
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP, until ctx is
+// done.
+func reloadOnSignal(ctx context.Context, cfg *config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if _, err := cfg.reload(); err != nil {
+				log.Errorf("failed reloading configuration, %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadHandler reloads the configuration on POST requests. The response
+// lists the results of the backend checks, if there were any.
+func (cfg *config) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	checks, err := cfg.reload()
+	msg := "configuration reloaded"
+	if err != nil {
+		log.Errorf("failed reloading configuration, %v", err)
+		msg = fmt.Sprintf("failed reloading configuration, %v", err)
+	}
+	for _, c := range checks {
+		msg += "\n" + c.String()
+	}
+	if err != nil {
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, msg)
+}
@@ -0,0 +1,179 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	metricPrefixRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE    = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// responseReplacement replaces a string in the responses of an http module,
+// for instance to fix links in its output.
+type responseReplacement struct {
+	From string                 `yaml:"from"`
+	To   string                 `yaml:"to"`
+	XXX  map[string]interface{} `yaml:",inline"`
+}
+
+// checkMetricPrefix checks that prefix can start a metric name, and doesn't
+// make names reserved for internal use (those starting with __).
+func checkMetricPrefix(prefix string) error {
+	if !metricPrefixRE.MatchString(prefix) {
+		return fmt.Errorf("%q is not a valid metric name prefix", prefix)
+	}
+	if strings.HasPrefix(prefix, "__") {
+		return fmt.Errorf("%q would make reserved metric names, starting with __", prefix)
+	}
+	return nil
+}
+
+// checkLabelName checks that name is a valid label name, and not one reserved
+// for internal use.
+func checkLabelName(name string) error {
+	if !labelNameRE.MatchString(name) {
+		return fmt.Errorf("%q is not a valid label name", name)
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name %q is reserved, starting with __", name)
+	}
+	return nil
+}
+
+// rewrites reports whether the module's output has to be parsed and
+// rewritten.
+func (cfg moduleConfig) rewrites() bool {
+	return cfg.MetricPrefix != "" || len(cfg.InjectLabels) != 0 || len(cfg.MetricRelabelConfigs) != 0
+}
+
+// rewriteMetricFamilies applies the module's metric_relabel_configs to mfs,
+// then adds its metric prefix to their names, and its injected labels to
+// their metrics. Histogram and summary series are named after their family,
+// so they are renamed along with it. Labels the metrics already have are left
+// as they are.
+func (cfg moduleConfig) rewriteMetricFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	if len(cfg.MetricRelabelConfigs) != 0 {
+		mfs = cfg.relabelMetricFamilies(mfs)
+	}
+
+	var names []string
+	for n := range cfg.InjectLabels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, mf := range mfs {
+		if cfg.MetricPrefix != "" {
+			name := cfg.MetricPrefix + mf.GetName()
+			mf.Name = &name
+		}
+		for _, m := range mf.Metric {
+			for _, n := range names {
+				if hasLabel(m, n) {
+					continue
+				}
+				n, v := n, cfg.InjectLabels[n]
+				m.Label = append(m.Label, &dto.LabelPair{Name: &n, Value: &v})
+			}
+		}
+	}
+	return mfs
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteResponse rewrites a buffered text or protobuf response as
+// rewriteMetricFamilies does. OpenMetrics responses are converted to, and
+// served in, the text format.
+func (cfg moduleConfig) rewriteResponse(res *http.Response) error {
+	format := expfmt.ResponseFormat(res.Header)
+	if format != expfmt.FmtProtoDelim {
+		format = expfmt.FmtText
+	}
+
+	body := io.Reader(res.Body)
+	if isOpenMetrics(res.Header) {
+		bs, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(openMetricsToText(bs))
+	}
+
+	var mfs []*dto.MetricFamily
+	dec := expfmt.NewDecoder(body, format)
+	for {
+		mf := &dto.MetricFamily{}
+		err := dec.Decode(mf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		mfs = append(mfs, mf)
+	}
+	mfs = cfg.rewriteMetricFamilies(mfs)
+
+	buf := &bytes.Buffer{}
+	enc := expfmt.NewEncoder(buf, format)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	res.Body = ioutil.NopCloser(buf)
+	res.ContentLength = int64(buf.Len())
+	res.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	res.Header.Set("Content-Type", string(format))
+	return nil
+}
+
+// replaceInResponse applies the module's response_replacements, in order, to
+// a buffered text format response.
+func (c httpConfig) replaceInResponse(res *http.Response) {
+	if expfmt.ResponseFormat(res.Header) == expfmt.FmtProtoDelim {
+		return
+	}
+	bs, _ := ioutil.ReadAll(res.Body)
+	for _, rr := range c.ResponseReplacements {
+		bs = bytes.ReplaceAll(bs, []byte(rr.From), []byte(rr.To))
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(bs))
+	res.ContentLength = int64(len(bs))
+	res.Header.Set("Content-Length", strconv.Itoa(len(bs)))
+}
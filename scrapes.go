@@ -0,0 +1,143 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// recentScrapesSize is the number of scrapes of each module kept in
+// recentScrapes.
+const recentScrapesSize = 10
+
+// recentScrapes keeps the results of the last few scrapes of each module, in
+// memory only, for troubleshooting.
+var recentScrapes = &scrapeHistory{records: make(map[string][]scrapeRecord)}
+
+type scrapeRecord struct {
+	Time     time.Time `json:"time"`
+	Status   int       `json:"status"`
+	Result   string    `json:"result"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+type scrapeHistory struct {
+	mutex   sync.Mutex
+	records map[string][]scrapeRecord
+}
+
+func (h *scrapeHistory) add(module string, rec scrapeRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	rs := append(h.records[module], rec)
+	if len(rs) > recentScrapesSize {
+		rs = rs[len(rs)-recentScrapesSize:]
+	}
+	h.records[module] = rs
+}
+
+func (h *scrapeHistory) get(module string) []scrapeRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]scrapeRecord{}, h.records[module]...)
+}
+
+func (h *scrapeHistory) reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = make(map[string][]scrapeRecord)
+}
+
+type moduleErrors struct {
+	Errors    float64        `json:"errors"`
+	Timeouts  float64        `json:"timeouts"`
+	Malformed float64        `json:"malformed"`
+	Partial   float64        `json:"partial"`
+	Recent    []scrapeRecord `json:"recent"`
+}
+
+// moduleErrors lists the error counters and recent scrapes of each module as
+// JSON. A POST clears the recent scrapes, the counters are left as they are.
+func (cfg *config) moduleErrors(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		log.Infof("clearing recent scrapes")
+		recentScrapes.reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The counters are read as collected, rather than with WithLabelValues,
+	// which would create series for modules that never had an error.
+	errs := counterValues(selfMetrics.proxyErrorCount)
+	timeouts := counterValues(selfMetrics.proxyTimeoutCount)
+	malformed := counterValues(selfMetrics.proxyMalformedCount)
+	partial := counterValues(selfMetrics.proxyPartialCount)
+
+	res := make(map[string]moduleErrors)
+	for name := range cfg.GetModules() {
+		res[name] = moduleErrors{
+			Errors:    errs[name],
+			Timeouts:  timeouts[name],
+			Malformed: malformed[name],
+			Partial:   partial[name],
+			Recent:    recentScrapes.get(name),
+		}
+	}
+
+	bs, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "Failed to produce JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bs)
+}
+
+// counterValues returns the values of the existing series of a counter
+// vector, by module.
+func counterValues(vec *prometheus.CounterVec) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	vs := make(map[string]float64)
+	for c := range ch {
+		var m dto.Metric
+		if err := c.Write(&m); err != nil {
+			continue
+		}
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "module" {
+				vs[l.GetValue()] += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return vs
+}
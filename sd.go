@@ -0,0 +1,85 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// targetGroup is a prometheus file_sd and http_sd target group.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// targetGroups returns a target group scraping each module through target,
+// sorted by module name. The scheme label is only set if scheme is not
+// empty.
+func (cfg *config) targetGroups(target, scheme string) []targetGroup {
+	modules := cfg.GetModules()
+	var names []string
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []targetGroup{}
+	for _, name := range names {
+		labels := map[string]string{
+			"__metrics_path__": cfg.routePrefix + cfg.proxyPath,
+			"__param_module":   name,
+		}
+		if scheme != "" {
+			labels["__scheme__"] = scheme
+		}
+		for l, v := range modules[name].labels {
+			labels[l] = v
+		}
+		for l, v := range modules[name].TargetLabels {
+			labels[l] = v
+		}
+		groups = append(groups, targetGroup{
+			Targets: []string{target},
+			Labels:  labels,
+		})
+	}
+	return groups
+}
+
+// sdHandler lists the modules as prometheus http_sd target groups. The target
+// is -discovery.file-sd-target if set, or else the host the request was sent
+// to.
+func (cfg *config) sdHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.proxyPath == "" {
+		http.Error(w, "proxying is disabled", http.StatusNotFound)
+		return
+	}
+	target := *discoveryFileSDTarget
+	if target == "" {
+		target = r.Host
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg.targetGroups(target, scheme)); err != nil {
+		log.Errorf("Failed writing targets, %v", err)
+	}
+}
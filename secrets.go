@@ -0,0 +1,231 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const secretResolveTimeout = 10 * time.Second
+
+// secretProvider resolves references to secrets held outside of the
+// configuration.
+type secretProvider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// secretProviders maps the scheme of a secret reference to the provider
+// resolving it. Values without a known scheme are used literally.
+var secretProviders = map[string]secretProvider{
+	"exec": execSecretProvider{},
+}
+
+// execSecretProvider resolves exec://<command> [args...] references to the
+// trimmed standard output of the command.
+type execSecretProvider struct{}
+
+func (execSecretProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", errors.New("no command given")
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// secret holds a credential, which may be periodically re-resolved from a
+// secretProvider.
+type secret struct {
+	ref      string
+	provider secretProvider
+
+	mutex sync.RWMutex
+	value string
+}
+
+var (
+	secretsMutex sync.Mutex
+	// loadingSecrets collects the secrets of the modules being loaded, by
+	// reference, while collectSecrets runs.
+	loadingSecrets map[string]*secret
+	// pinnedSecrets are the secrets created outside of module loading, such
+	// as the global bearer token, which are kept for as long as the process
+	// runs.
+	pinnedSecrets = map[string]*secret{}
+)
+
+// staticSecret returns a secret with a fixed value.
+func staticSecret(v string) *secret {
+	return &secret{value: v}
+}
+
+// newSecret returns the secret for a configured value, resolving it if it
+// refers to a secret provider. Secrets from providers are shared between all
+// users of the same reference in the modules being loaded, or outside of
+// them.
+func newSecret(v string) (*secret, error) {
+	scheme, ref, ok := strings.Cut(v, "://")
+	provider, known := secretProviders[scheme]
+	if !ok || !known {
+		return staticSecret(v), nil
+	}
+	if scheme == "exec" && *disableExec {
+		return nil, errors.New("exec secrets can't be used with -disable.exec")
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	secrets := pinnedSecrets
+	if loadingSecrets != nil {
+		secrets = loadingSecrets
+	}
+	if s, ok := secrets[v]; ok {
+		return s, nil
+	}
+
+	s := &secret{ref: ref, provider: provider}
+	if err := s.refresh(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed resolving %s secret, %w", scheme, err)
+	}
+	secrets[v] = s
+	return s, nil
+}
+
+// collectSecrets calls load, returning the secrets from providers created
+// while it ran, so that they can be kept with the modules it loads and
+// dropped along with them. Loads must not run concurrently.
+func collectSecrets(load func() error) (map[string]*secret, error) {
+	secretsMutex.Lock()
+	loadingSecrets = map[string]*secret{}
+	secretsMutex.Unlock()
+
+	err := load()
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	secrets := loadingSecrets
+	loadingSecrets = nil
+	return secrets, err
+}
+
+// Get returns the current value of the secret.
+func (s *secret) Get() string {
+	if s == nil {
+		return ""
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.value
+}
+
+// resolve returns the value the provider currently gives the secret.
+func (s *secret) resolve(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, secretResolveTimeout)
+	defer cancel()
+	v, err := s.provider.Resolve(ctx, s.ref)
+	if err != nil {
+		return "", err
+	}
+	if v == "" {
+		return "", errors.New("secret is empty")
+	}
+	return v, nil
+}
+
+func (s *secret) refresh(ctx context.Context) error {
+	if s.provider == nil {
+		return nil
+	}
+	v, err := s.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.value = v
+	s.mutex.Unlock()
+	return nil
+}
+
+// refreshSecrets re-resolves the secrets taken from providers every interval.
+func refreshSecrets(ctx context.Context, cfg *config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		refreshSecretsOnce(ctx, cfg)
+	}
+}
+
+// refreshSecretsOnce re-resolves the secrets taken from providers. The
+// modules are not changed in place: if one of their secrets has changed, the
+// configuration is reloaded, swapping in modules with the new values as any
+// other reload does. Secrets outside of the modules, such as the global bearer
+// token, are not reloadable, and are updated in place. A secret that fails to
+// resolve keeps its previous value.
+func refreshSecretsOnce(ctx context.Context, cfg *config) {
+	secretsMutex.Lock()
+	pinned := make([]*secret, 0, len(pinnedSecrets))
+	for _, s := range pinnedSecrets {
+		pinned = append(pinned, s)
+	}
+	secretsMutex.Unlock()
+	for _, s := range pinned {
+		if err := s.refresh(ctx); err != nil {
+			log.Warnf("failed refreshing secret, keeping previous value, %v", err)
+		}
+	}
+
+	cfg.mutex.RLock()
+	modules := make([]*secret, 0, len(cfg.secrets))
+	for _, s := range cfg.secrets {
+		modules = append(modules, s)
+	}
+	cfg.mutex.RUnlock()
+	for _, s := range modules {
+		v, err := s.resolve(ctx)
+		if err != nil {
+			log.Warnf("failed refreshing secret, keeping previous value, %v", err)
+			continue
+		}
+		if v != s.Get() {
+			log.Infof("a secret of the modules has changed, reloading the configuration")
+			if _, err := cfg.reload(); err != nil {
+				log.Errorf("failed reloading the configuration for a changed secret, keeping previous values, %v", err)
+			}
+			return
+		}
+	}
+}
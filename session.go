@@ -0,0 +1,140 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loginConfig describes a form login that must be made to obtain session
+// cookies before a backend can be scraped. The cookies are only kept in
+// memory.
+type loginConfig struct {
+	Path   string                 `yaml:"path"`
+	Method string                 `yaml:"method"` // POST
+	Form   map[string]string      `yaml:"form"`
+	XXX    map[string]interface{} `yaml:",inline"`
+
+	form map[string]*secret
+
+	mutex   sync.Mutex
+	cookies []*http.Cookie
+}
+
+func checkLoginConfig(c *loginConfig) error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("unknown login configuration fields: %v", c.XXX)
+	}
+	if c.Path == "" {
+		return fmt.Errorf("path must be set")
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+
+	c.form = make(map[string]*secret)
+	for k, v := range c.Form {
+		s, err := newSecret(v)
+		if err != nil {
+			return fmt.Errorf("form field %v, %w", k, err)
+		}
+		c.form[k] = s
+	}
+	return nil
+}
+
+// session returns the session cookies, logging in to the backend at base
+// with client first if there are none.
+func (c *loginConfig) session(ctx context.Context, client *http.Client, base *url.URL) ([]*http.Cookie, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cookies != nil {
+		return c.cookies, nil
+	}
+
+	u := *base
+	u.Path = c.Path
+	form := url.Values{}
+	for k, v := range c.form {
+		form.Set(k, v.Get())
+	}
+
+	var body io.Reader
+	if c.Method == http.MethodGet {
+		u.RawQuery = form.Encode()
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("login failed, %w", err)
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return nil, fmt.Errorf("login failed with status %d", res.StatusCode)
+	}
+	cookies := res.Cookies()
+	if len(cookies) == 0 {
+		return nil, fmt.Errorf("login response set no cookies")
+	}
+	log.Debugf("logged in to %v", u.Host)
+	c.cookies = cookies
+	return cookies, nil
+}
+
+// current returns the session cookies, if logged in.
+func (c *loginConfig) current() []*http.Cookie {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cookies
+}
+
+// expire discards the session cookies, so that the next scrape logs in again.
+func (c *loginConfig) expire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cookies = nil
+}
+
+// sessionExpired reports whether a backend response suggests that the session
+// is no longer valid: it was refused, or redirected, presumably to a login
+// page.
+func sessionExpired(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusUnauthorized,
+		http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shuttingDown is set once a shutdown has been requested.
+var shuttingDown int32
+
+// shutdownContext returns a context that is cancelled delay after the process
+// is sent SIGTERM or SIGINT, while /-/ready reports that it is not ready, to
+// start a graceful shutdown. A second signal terminates the process
+// immediately.
+func shutdownContext(delay time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		atomic.StoreInt32(&shuttingDown, 1)
+		if delay > 0 {
+			log.Infof("Received %v, shutting down in %v", sig, delay)
+			time.Sleep(delay)
+		} else {
+			log.Infof("Received %v", sig)
+		}
+		log.Infof("Shutting down, waiting for requests in progress to complete")
+		cancel()
+	}()
+	return ctx
+}
+
+// ready responds with a 200 until a shutdown has been requested, and with a
+// 503 after that.
+func ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errTargetNotAllowed is returned when dialing a backend that is not allowed
+// by -backend.allowed-targets.
+var errTargetNotAllowed = errors.New("backend target not allowed")
+
+// allowedTargets lists the backends that may be connected to. Any backend may
+// be connected to if it is empty.
+var allowedTargets targetPatternsFlag
+
+type targetPattern struct {
+	host    string // a host name, or empty for network
+	network *net.IPNet
+	port    string // * for any port
+}
+
+func (p targetPattern) String() string {
+	host := p.host
+	if p.network != nil {
+		host = p.network.String()
+	}
+	return net.JoinHostPort(host, p.port)
+}
+
+func (p targetPattern) allowsPort(port string) bool {
+	return p.port == "*" || p.port == port
+}
+
+// targetPatternsFlag is a flag of host:port patterns, whose host may be a
+// host name, an IP address or a CIDR network, and whose port may be left out,
+// or be *, to allow any port.
+type targetPatternsFlag []targetPattern
+
+func (ps targetPatternsFlag) String() string {
+	strs := make([]string, len(ps))
+	for i := range ps {
+		strs[i] = ps[i].String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+func (ps *targetPatternsFlag) Set(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		host, port = value, "*"
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("bad target %q, expected host:port", value)
+	}
+
+	p := targetPattern{port: port}
+	switch {
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return err
+		}
+		p.network = network
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		p.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		p.host = strings.ToLower(host)
+	}
+	*ps = append(*ps, p)
+	return nil
+}
+
+func (ps targetPatternsFlag) allowsName(host, port string) bool {
+	for _, p := range ps {
+		if p.host != "" && p.host == strings.ToLower(host) && p.allowsPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps targetPatternsFlag) allowsIP(ip net.IP, port string) bool {
+	for _, p := range ps {
+		if p.network != nil && p.network.Contains(ip) && p.allowsPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkedDial wraps dial, only allowing connections to the targets allowed by
+// -backend.allowed-targets. Host names that aren't allowed by name are
+// resolved with lookup, and only the addresses that are allowed are dialed,
+// so the check can't be evaded by the name resolving differently later.
+func checkedDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	lookup func(ctx context.Context, host string) ([]string, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if len(allowedTargets) == 0 {
+			return dial(ctx, network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if allowedTargets.allowsName(host, port) {
+			return dial(ctx, network, address)
+		}
+
+		addrs := []string{host}
+		if net.ParseIP(host) == nil {
+			if addrs, err = lookup(ctx, host); err != nil {
+				return nil, err
+			}
+		}
+		var allowed []string
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil && allowedTargets.allowsIP(ip, port) {
+				allowed = append(allowed, a)
+			}
+		}
+		if len(allowed) == 0 {
+			log.Warnf("refused connecting to backend %v, it is not allowed by -backend.allowed-targets", address)
+			return nil, fmt.Errorf("%w: %v", errTargetNotAllowed, address)
+		}
+
+		for _, a := range allowed {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(a, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"runtime"
 
-	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -16,19 +18,25 @@ var (
 	GoVersion = runtime.Version()
 )
 
-var buildInfo = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Name: "build_info",
-		Help: "A metric with a constant '1' value labeled by version, revision, branch and goversion from which exporter_exporter was built.",
-	},
-	[]string{"version", "revision", "branch", "goversion"},
-)
-
-func init() {
-	prometheus.MustRegister(buildInfo)
-	buildInfo.WithLabelValues(Version, Revision, Branch, GoVersion).Set(1)
-}
-
 func versionStr() string {
 	return fmt.Sprintf("%s-%s (from %s, built by %s on %s)", Version, Revision, Branch, BuildUser, BuildDate)
 }
+
+// versionHandler serves the build information as JSON.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	bs, err := json.MarshalIndent(map[string]string{
+		"version":   Version,
+		"revision":  Revision,
+		"branch":    Branch,
+		"buildUser": BuildUser,
+		"buildDate": BuildDate,
+		"goVersion": GoVersion,
+	}, "", "  ")
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "Failed to produce JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bs)
+}